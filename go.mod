@@ -9,6 +9,6 @@ require (
 	github.com/modood/table v0.0.0-20200225102042-88de94bb9876
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/yuin/gopher-lua v0.0.0-20200603152657-dc2b0ca8b37e
-	golang.org/x/net v0.0.0-20201021035429-f5854403a974 // indirect
-	golang.org/x/sys v0.0.0-20201218084310-7d0127a74742 // indirect
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	golang.org/x/sys v0.0.0-20201218084310-7d0127a74742
 )
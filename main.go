@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"runtime"
 
 	flag "github.com/bugwz/go-flag"
 	s "github.com/bugwz/hamburg/src"
@@ -10,10 +11,11 @@ import (
 
 var version = "1.0"
 var (
-	snaplen                                                     int
-	slow, count, duration                                       int64
+	snaplen, workers, topn, files                               int
+	slow, count, matches, duration, interval, size, age, ring   int64
 	interfile, outfile, fips, fports, protocol, script, fcustom string
-	showreply, help                                             bool
+	metrics, format, statsfile, mergefiles, outmode, routes     string
+	showreply, tui, help                                        bool
 )
 
 func usage() {
@@ -35,15 +37,31 @@ Options:
 
 func init() {
 	flag.StringVar(&interfile, "i", "", "monitor network interface or offline pcap file")
-	flag.StringVar(&outfile, "o", "", "outfile for the captured package")
-	flag.StringVar(&fips, "s", "", "filtered ip list, splited with commas")
+	flag.StringVar(&outfile, "o", "", "outfile for the captured package, written in pcapng format with the annotations of requests if named as *.pcapng")
+	flag.Int64Var(&size, "z", 0, "rotate the outfile when its size exceeds (MB), (default unlimited)")
+	flag.Int64Var(&age, "g", 0, "rotate the outfile when its packets span longer than (second), (default unlimited)")
+	flag.IntVar(&files, "y", 0, "number of the latest rotated outfiles kept, (default unlimited)")
+	flag.Int64Var(&ring, "b", 0, "keep the latest packets (MB) in memory and save them into outfile when slow requests are detected")
+	flag.StringVar(&outmode, "O", "all", "packets saved into outfile with all/slow/conn, slow and conn for the packets of slow requests or their connections")
+	flag.StringVar(&fips, "s", "", "filtered ip or prefix list (IPv4/IPv6), splited with commas")
 	flag.StringVar(&fports, "p", "", "filtered port list, splited with commas")
-	flag.StringVar(&protocol, "m", "raw", "packet protocol type with raw/dns/http/redis/memcached/mysql")
+	flag.StringVar(&protocol, "m", "raw", "packet protocol type with raw/dns/http/http2/grpc/redis/memcached/mysql/postgres/mongodb")
 	flag.Int64Var(&slow, "t", 1, "threshold for slow requests (millisecond)")
 	flag.Int64Var(&duration, "d", 0, "running time for capturing packets (second), (default unlimited)")
+	flag.Int64Var(&count, "c", 0, "number of captured packets to stop after, (default unlimited)")
+	flag.Int64Var(&matches, "q", 0, "number of matched requests to stop after, (default unlimited)")
 	flag.StringVar(&script, "x", "", "lua script file")
 	flag.IntVar(&snaplen, "n", 1500, "maximum length of the captured data packet snaplen")
 	flag.StringVar(&fcustom, "e", "", "customized packet filter")
+	flag.IntVar(&workers, "w", runtime.NumCPU(), "number of workers decoding packets in parallel")
+	flag.StringVar(&format, "f", "text", "output format of the slow requests with text/json/logfmt")
+	flag.StringVar(&metrics, "l", "", "listen address of the prometheus metrics endpoint, e.g. :9100")
+	flag.StringVar(&routes, "R", "", "route patterns of http paths splited with commas like /users/{id}, the numeric/uuid/hex segments are replaced automatically")
+	flag.IntVar(&topn, "k", 10, "number of the slowest server and command pairs shown in summary")
+	flag.Int64Var(&interval, "u", 0, "interval for printing the rolling stats (second), (default disabled)")
+	flag.StringVar(&statsfile, "j", "", "save the stats as json into file on exit")
+	flag.StringVar(&mergefiles, "r", "", "merge the stats files splited with commas and show the summary")
+	flag.BoolVar(&tui, "v", false, "show the live terminal ui like top instead of the slow log (default false)")
 	flag.BoolVar(&showreply, "a", false, "show the contents of the reply packet (default false)")
 	flag.BoolVar(&help, "h", false, "help")
 
@@ -63,6 +81,22 @@ func setconf(c *s.Conf) {
 	c.Script = script
 	c.FilterCustom = fcustom
 	c.ShowReply = showreply
+	c.Workers = workers
+	c.MetricsAddr = metrics
+	c.Format = format
+	c.TopN = topn
+	c.StatsFile = statsfile
+	c.Interval = interval
+	c.TUI = tui
+	c.PacketCount = count
+	c.MatchCount = matches
+	c.OutfileSize = size
+	c.OutfileAge = age
+	c.OutfileCount = files
+	c.RingSize = ring
+	c.OutfileMode = outmode
+	c.Routes = routes
+	c.MergeFiles = mergefiles
 }
 
 func main() {
@@ -74,6 +108,13 @@ func main() {
 	}
 
 	setconf(c)
+	if c.MergeFiles != "" {
+		if e := s.ReportStats(c, c.MergeFiles); e != nil {
+			fmt.Println(e)
+		}
+		return
+	}
+
 	h, e := s.NewHamburg(c)
 	if e != nil {
 		fmt.Println(e)
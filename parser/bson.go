@@ -0,0 +1,250 @@
+package parser
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BSON element types (http://bsonspec.org/spec.html)
+const (
+	BSONDouble     = 0x01
+	BSONString     = 0x02
+	BSONDocument   = 0x03
+	BSONArray      = 0x04
+	BSONBinary     = 0x05
+	BSONUndefined  = 0x06
+	BSONObjectID   = 0x07
+	BSONBool       = 0x08
+	BSONDatetime   = 0x09
+	BSONNull       = 0x0A
+	BSONRegex      = 0x0B
+	BSONDBPointer  = 0x0C
+	BSONJavaScript = 0x0D
+	BSONSymbol     = 0x0E
+	BSONCodeScope  = 0x0F
+	BSONInt32      = 0x10
+	BSONTimestamp  = 0x11
+	BSONInt64      = 0x12
+	BSONDecimal128 = 0x13
+	BSONMinKey     = 0xFF
+	BSONMaxKey     = 0x7F
+)
+
+// BSONMaxDepth maximum nesting depth of rendered documents and arrays
+const BSONMaxDepth = 128
+
+// BSONElem element of bson document
+type BSONElem struct {
+	Key   string
+	Type  byte
+	Value []byte
+}
+
+// BSONDoc decode the elements of bson document, return them and the size of document
+func BSONDoc(b []byte) ([]*BSONElem, int, error) {
+	if len(b) < 5 {
+		return nil, 0, fmt.Errorf("bson document is too short")
+	}
+	size := int(int32(binary.LittleEndian.Uint32(b)))
+	if size < 5 || size > len(b) {
+		return nil, 0, fmt.Errorf("bson document size %d is illegal", size)
+	}
+
+	var elems []*BSONElem
+	pos := 4
+	for pos < size-1 {
+		typ := b[pos]
+		pos++
+		end := strings.IndexByte(string(b[pos:size]), 0)
+		if end < 0 {
+			return nil, 0, fmt.Errorf("bson key is not terminated")
+		}
+		key := string(b[pos : pos+end])
+		pos += end + 1
+
+		n := bsonSize(typ, b[pos:size])
+		if n < 0 {
+			return nil, 0, fmt.Errorf("bson element %s is illegal", key)
+		}
+		elems = append(elems, &BSONElem{Key: key, Type: typ, Value: b[pos : pos+n]})
+		pos += n
+	}
+
+	return elems, size, nil
+}
+
+// bsonSize size of the element value, -1 if the value is illegal
+func bsonSize(typ byte, b []byte) int {
+	n := -1
+	switch typ {
+	case BSONUndefined, BSONNull, BSONMinKey, BSONMaxKey:
+		n = 0
+	case BSONBool:
+		n = 1
+	case BSONInt32:
+		n = 4
+	case BSONDouble, BSONDatetime, BSONTimestamp, BSONInt64:
+		n = 8
+	case BSONObjectID:
+		n = 12
+	case BSONDecimal128:
+		n = 16
+	case BSONString, BSONJavaScript, BSONSymbol:
+		if len(b) >= 4 {
+			n = 4 + int(int32(binary.LittleEndian.Uint32(b)))
+		}
+	case BSONDocument, BSONArray, BSONCodeScope:
+		if len(b) >= 4 {
+			n = int(int32(binary.LittleEndian.Uint32(b)))
+		}
+	case BSONBinary:
+		if len(b) >= 4 {
+			n = 5 + int(int32(binary.LittleEndian.Uint32(b)))
+		}
+	case BSONDBPointer:
+		if len(b) >= 4 {
+			n = 4 + int(int32(binary.LittleEndian.Uint32(b))) + 12
+		}
+	case BSONRegex:
+		if i := strings.IndexByte(string(b), 0); i >= 0 {
+			if j := strings.IndexByte(string(b[i+1:]), 0); j >= 0 {
+				n = i + j + 2
+			}
+		}
+	}
+	if n < 0 || n > len(b) {
+		return -1
+	}
+
+	return n
+}
+
+// bsonFind find the element by key
+func bsonFind(elems []*BSONElem, key string) *BSONElem {
+	for _, e := range elems {
+		if e.Key == key {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// String text of the string element
+func (e *BSONElem) String() string {
+	if e.Type != BSONString || len(e.Value) < 5 {
+		return ""
+	}
+
+	return string(e.Value[4 : len(e.Value)-1])
+}
+
+// Int integer value of the numeric element
+func (e *BSONElem) Int() int64 {
+	switch e.Type {
+	case BSONInt32:
+		return int64(int32(binary.LittleEndian.Uint32(e.Value)))
+	case BSONInt64:
+		return int64(binary.LittleEndian.Uint64(e.Value))
+	case BSONDouble:
+		return int64(math.Float64frombits(binary.LittleEndian.Uint64(e.Value)))
+	case BSONBool:
+		if e.Value[0] != 0 {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// BSONText render the document as relaxed extended json, skipping the keys in skip
+func BSONText(elems []*BSONElem, array bool, skip ...string) string {
+	return bsonText(elems, array, 0, skip...)
+}
+
+// bsonText render the document at the nesting depth
+func bsonText(elems []*BSONElem, array bool, depth int, skip ...string) string {
+	var b strings.Builder
+	if array {
+		b.WriteByte('[')
+	} else {
+		b.WriteByte('{')
+	}
+
+	first := true
+loop:
+	for _, e := range elems {
+		for _, k := range skip {
+			if e.Key == k {
+				continue loop
+			}
+		}
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		if !array {
+			b.WriteString(strconv.Quote(e.Key))
+			b.WriteByte(':')
+		}
+		b.WriteString(bsonValue(e, depth))
+	}
+
+	if array {
+		b.WriteByte(']')
+	} else {
+		b.WriteByte('}')
+	}
+
+	return b.String()
+}
+
+// bsonValue render the element value, the documents nested deeper than BSONMaxDepth
+// are rendered as "..."
+func bsonValue(e *BSONElem, depth int) string {
+	v := e.Value
+	switch e.Type {
+	case BSONDouble:
+		return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(v)), 'g', -1, 64)
+	case BSONString, BSONSymbol, BSONJavaScript:
+		return strconv.Quote(e.String())
+	case BSONDocument, BSONArray:
+		if depth >= BSONMaxDepth {
+			return `"..."`
+		}
+		elems, _, err := BSONDoc(v)
+		if err != nil {
+			return "?"
+		}
+		return bsonText(elems, e.Type == BSONArray, depth+1)
+	case BSONBinary:
+		return fmt.Sprintf(`{"$binary":"%d bytes"}`, len(v)-5)
+	case BSONObjectID:
+		return fmt.Sprintf(`ObjectId("%s")`, hex.EncodeToString(v))
+	case BSONBool:
+		return strconv.FormatBool(v[0] != 0)
+	case BSONDatetime:
+		ms := int64(binary.LittleEndian.Uint64(v))
+		return fmt.Sprintf(`ISODate("%s")`, time.Unix(ms/1000, ms%1000*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano))
+	case BSONNull, BSONUndefined:
+		return "null"
+	case BSONInt32, BSONInt64:
+		return strconv.FormatInt(e.Int(), 10)
+	case BSONTimestamp:
+		return fmt.Sprintf("Timestamp(%d, %d)", binary.LittleEndian.Uint32(v[4:]), binary.LittleEndian.Uint32(v))
+	case BSONRegex:
+		parts := strings.SplitN(string(v), "\x00", 3)
+		return fmt.Sprintf("/%s/%s", parts[0], parts[1])
+	case BSONMinKey:
+		return "MinKey"
+	case BSONMaxKey:
+		return "MaxKey"
+	}
+
+	return fmt.Sprintf(`"<type 0x%02x>"`, e.Type)
+}
@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"net"
 	"strings"
 )
 
@@ -130,6 +131,16 @@ var DNSClass = map[int]string{
 	DCHS: "HS", // Hesiod [Dyer 87]
 }
 
+// DNSRcode names of the response codes
+var DNSRcode = map[int]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
 // DNSParser dns parser
 type DNSParser struct{}
 
@@ -176,6 +187,9 @@ func (*DNSParser) Run(v *Packet) {
 			}
 			pos += 4 // ignore query class(2 bytes)
 			domains = append(domains, fmt.Sprintf("[%s] %s", qtype, strings.Join(dmeta, ".")))
+			if v.Command == "" {
+				v.Command = qtype
+			}
 
 		}
 		v.Content = strings.Join(domains, ", ")
@@ -184,6 +198,12 @@ func (*DNSParser) Run(v *Packet) {
 
 	// Response
 	v.Request = false
+	rcode := code & 0x0F
+	v.Status = fmt.Sprintf("%d", rcode)
+	if DNSRcode[rcode] != "" {
+		v.Status = DNSRcode[rcode]
+	}
+	v.Error = rcode != 0 && rcode != 3
 	for i := 0; i < qcount; i++ {
 		size := int(meta[pos])
 		for size != 0 {
@@ -226,6 +246,12 @@ func (*DNSParser) Run(v *Packet) {
 			records[atype] = append(records[atype], fmt.Sprintf("%d.%d.%d.%d",
 				meta[pos], meta[pos+1], meta[pos+2], meta[pos+3]))
 			pos += 4
+		case DNSTypeAAAA:
+			if len(meta) < pos+16 {
+				break
+			}
+			records[atype] = append(records[atype], net.IP(meta[pos:pos+16]).String())
+			pos += 16
 		case DNSTypeCNAME:
 			if len(meta) <= pos+datalen {
 				break
@@ -1,47 +1,292 @@
 package parser
 
 import (
+	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
-// HTTPParser http parser
-type HTTPParser struct{}
+// HTTPMethods methods of the request line
+var HTTPMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"CONNECT": true, "OPTIONS": true, "TRACE": true, "PATCH": true,
+}
+
+// HTTPContentSize maximum length of the undecoded message shown in content
+const HTTPContentSize = 1024
+
+// HTTPMaxChunkSize size of a chunk to give up framing
+const HTTPMaxChunkSize = 64 << 20
+
+// HTTPHeaders headers shown in the content of messages
+var HTTPHeaders = []string{"content-type", "user-agent", "x-request-id", "x-forwarded-for"}
+
+// HTTPMessage start line and headers of a http message
+type HTTPMessage struct {
+	Request bool              // Whether the message is a request
+	Method  string            // Method of request
+	Target  string            // Request target, the path or absolute url
+	Version string            // Protocol version such as HTTP/1.1
+	Code    int               // Status code of response
+	Reason  string            // Reason phrase of response
+	Headers map[string]string // Headers by lower case name, the first one is kept
+	Length  int               // Content-Length, -1 if absent
+	Chunked bool              // Whether the body is chunked
+	Size    int               // Length of the start line and headers
+}
+
+// HTTPConn state of a http connection
+type HTTPConn struct {
+	methods []string // Methods of the outstanding requests in order
+	chunked [2]bool  // Whether the chunked body of request and response is being framed
+}
+
+// HTTPParser http/1.x parser
+type HTTPParser struct {
+	conns map[string]*HTTPConn // Connections by "client -> server"
+}
+
+// conn find or create the state of connection
+func (h *HTTPParser) conn(v *Packet) *HTTPConn {
+	if h.conns == nil {
+		h.conns = make(map[string]*HTTPConn)
+	}
+
+	id := ConnID(v)
+	c, ok := h.conns[id]
+	if !ok {
+		c = &HTTPConn{}
+		h.conns[id] = c
+	}
+
+	return c
+}
+
+// Close release the state of connection
+func (h *HTTPParser) Close(v *Packet) {
+	delete(h.conns, ConnID(v))
+}
+
+// Reset drop the chunked body being framed in the direction of v
+func (h *HTTPParser) Reset(v *Packet) {
+	h.conn(v).chunked[httpSide(v)] = false
+}
 
-// Run parse packets
+// Run parse the message
 func (h *HTTPParser) Run(v *Packet) {
-	var rtype, host, path string
-
-	pls := strings.Split(v.Payload, "\r\n")
-	for _, it := range pls {
-		if strings.Contains(it, "Host: ") {
-			if info := strings.Split(it, " "); len(info) == 2 {
-				v.Request = true
-				host = info[1]
-				break
-			}
+	m, n := httpHeader([]byte(v.Payload))
+	if n <= 0 {
+		line := v.Payload
+		if i := strings.Index(line, "\r\n"); i >= 0 {
+			line = line[:i]
 		}
-		if strings.Contains(it, "Server: ") {
-			if info := strings.Split(it, " "); len(info) == 2 {
-				v.Request = false
-				host = info[1]
-				break
-			}
+		if len(line) > HTTPContentSize {
+			line = line[:HTTPContentSize] + "..."
+		}
+		v.Content = line
+		return
+	}
+
+	v.Request = m.Request
+	body := v.PayloadLen - m.Size
+	var extra []string
+	for _, k := range HTTPHeaders {
+		if hv, ok := m.Headers[k]; ok {
+			extra = append(extra, fmt.Sprintf("%s=%s", k, strconv.Quote(hv)))
 		}
 	}
+	if body > 0 {
+		extra = append(extra, fmt.Sprintf("length=%d", body))
+	}
 
-	if len(pls) > 2 {
-		if v.Request {
-			if info := strings.Split(pls[0], " "); len(info) >= 3 {
-				rtype = fmt.Sprintf("[%s %s]", info[2], info[0])
-				path = info[1]
+	if m.Request {
+		host, path := m.Headers["host"], m.Target
+		if i := strings.Index(path, "://"); i >= 0 {
+			// Absolute form used by proxies
+			path = path[i+3:]
+			if j := strings.IndexByte(path, '/'); j >= 0 {
+				host, path = path[:j], path[j:]
+			} else {
+				host, path = path, "/"
 			}
+		}
+		route := path
+		if i := strings.IndexAny(route, "?#"); i >= 0 {
+			route = route[:i]
+		}
+		v.Command = fmt.Sprintf("%s %s", m.Method, route)
+		v.Content = strings.Join(append([]string{fmt.Sprintf("[%s %s] %s%s", m.Version, m.Method, host, path)}, extra...), " ")
+		return
+	}
+
+	// The interim responses precede the final one of the same request
+	if m.Code < 200 {
+		v.Ignore = true
+	}
+	v.Status = strconv.Itoa(m.Code)
+	v.Error = m.Code >= 500
+	v.Content = strings.Join(append([]string{fmt.Sprintf("[%s %d %s]", m.Version, m.Code, m.Reason)}, extra...), " ")
+}
+
+// Split split the stream by the headers and the length of body, the responses
+// to HEAD and the ones with status 1xx, 204 and 304 have no body, and the chunked
+// body is framed chunk by chunk
+func (h *HTTPParser) Split(v *Packet, data []byte) (int, bool) {
+	c := h.conn(v)
+	side := httpSide(v)
+	if c.chunked[side] {
+		n, more := httpChunk(data)
+		c.chunked[side] = n == 0 || more
+		return n, more
+	}
+
+	m, hlen := httpHeader(data)
+	if hlen <= 0 {
+		return hlen, false
+	}
+
+	size := m.Length
+	if !m.Request && (m.Code < 200 || m.Code == 204 || m.Code == 304 ||
+		len(c.methods) > 0 && c.methods[0] == "HEAD") {
+		size = 0
+	}
+
+	n := 0
+	switch {
+	case size == 0:
+		n = hlen
+	case m.Chunked:
+		n = hlen
+		c.chunked[side] = true
+	case size < 0:
+		// Requests without length have no body, responses last until close
+		if m.Request {
+			n = hlen
 		} else {
-			if info := strings.Split(pls[0], " "); len(info) >= 2 {
-				rtype = fmt.Sprintf("[%s %s]", info[0], info[1])
+			n = len(data)
+		}
+	default:
+		n = hlen + size
+	}
+
+	// Track the methods of pipelined requests for their final responses
+	if m.Request {
+		c.methods = append(c.methods, m.Method)
+	} else if m.Code >= 200 && len(c.methods) > 0 {
+		c.methods = c.methods[1:]
+	}
+
+	return n, c.chunked[side]
+}
+
+// httpSide index of the direction of v, 0 for request and 1 for response
+func httpSide(v *Packet) int {
+	if v.Request {
+		return 0
+	}
+
+	return 1
+}
+
+// httpHeader parse the start line and headers, return the message and the length
+// of them, 0 if more data is needed, or -1 if the data is not a http message
+func httpHeader(data []byte) (*HTTPMessage, int) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		// The start line is checked early so that garbage is not buffered forever
+		if i := bytes.Index(data, []byte("\r\n")); i >= 0 && httpStartLine(&HTTPMessage{}, string(data[:i])) != nil {
+			return nil, -1
+		}
+		return nil, 0
+	}
+
+	lines := strings.Split(string(data[:end]), "\r\n")
+	m := &HTTPMessage{Headers: make(map[string]string), Length: -1, Size: end + 4}
+	if e := httpStartLine(m, lines[0]); e != nil {
+		return nil, -1
+	}
+
+	for _, line := range lines[1:] {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		k, hv := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		if _, ok := m.Headers[k]; !ok {
+			m.Headers[k] = hv
+		}
+		switch k {
+		case "content-length":
+			n, e := strconv.Atoi(hv)
+			if e != nil || n < 0 {
+				return nil, -1
 			}
+			m.Length = n
+		case "transfer-encoding":
+			m.Chunked = strings.Contains(strings.ToLower(hv), "chunked")
+		}
+	}
+
+	return m, m.Size
+}
+
+// httpStartLine parse the request line or status line
+func httpStartLine(m *HTTPMessage, line string) error {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return fmt.Errorf("Illegal http start line: %s", line)
+	}
+
+	if strings.HasPrefix(parts[0], "HTTP/") {
+		code, e := strconv.Atoi(parts[1])
+		if e != nil || code < 100 || code > 999 {
+			return fmt.Errorf("Illegal http status code: %s", parts[1])
+		}
+		m.Version, m.Code = parts[0], code
+		if len(parts) == 3 {
+			m.Reason = parts[2]
 		}
+		return nil
 	}
 
-	v.Content = fmt.Sprintf("%s %s%s", rtype, host, path)
+	if len(parts) != 3 || !HTTPMethods[parts[0]] || !strings.HasPrefix(parts[2], "HTTP/") {
+		return fmt.Errorf("Illegal http request line: %s", line)
+	}
+	m.Request = true
+	m.Method, m.Target, m.Version = parts[0], parts[1], parts[2]
+
+	return nil
+}
+
+// httpChunk return the length of the chunk at the start of data and whether more
+// chunks follow, the last chunk is followed by optional trailers and an empty line
+func httpChunk(data []byte) (int, bool) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		return 0, false
+	}
+	line := string(data[:end])
+	if i := strings.Index(line, ";"); i >= 0 {
+		line = line[:i]
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+	if err != nil || size < 0 || size > HTTPMaxChunkSize {
+		return -1, false
+	}
+	pos := end + 2
+	if size > 0 {
+		return pos + int(size) + 2, true
+	}
+
+	for {
+		end = bytes.Index(data[pos:], []byte("\r\n"))
+		if end < 0 {
+			return 0, false
+		}
+		pos += end + 2
+		if end == 0 {
+			return pos, false
+		}
+	}
 }
@@ -0,0 +1,344 @@
+package parser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP2Preface connection preface sent by the client
+const HTTP2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Frame types of http2
+const (
+	HTTP2Data         = 0x0
+	HTTP2Headers      = 0x1
+	HTTP2Priority     = 0x2
+	HTTP2RstStream    = 0x3
+	HTTP2Settings     = 0x4
+	HTTP2PushPromise  = 0x5
+	HTTP2Ping         = 0x6
+	HTTP2GoAway       = 0x7
+	HTTP2WindowUpdate = 0x8
+	HTTP2Continuation = 0x9
+)
+
+// Frame flags of http2
+const (
+	HTTP2FlagEndStream  = 0x1
+	HTTP2FlagAck        = 0x1
+	HTTP2FlagEndHeaders = 0x4
+	HTTP2FlagPadded     = 0x8
+	HTTP2FlagPriority   = 0x20
+)
+
+// HTTP2FrameHeaderLen length of frame header
+const HTTP2FrameHeaderLen = 9
+
+// HTTP2MaxFrameSize maximum frame size accepted, larger frames mean the stream is not http2
+const HTTP2MaxFrameSize = 1 << 20
+
+// HTTP2HeaderTableSize default size of hpack dynamic table
+const HTTP2HeaderTableSize = 4096
+
+// HTTP2SettingsHeaderTableSize id of SETTINGS_HEADER_TABLE_SIZE
+const HTTP2SettingsHeaderTableSize = 0x1
+
+// GRPCStatus names of the grpc status codes
+var GRPCStatus = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND",
+	"ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION",
+	"ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// HTTP2Stream state of a stream
+type HTTP2Stream struct {
+	method    string // :method of request
+	path      string // :path of request, which is the method of grpc
+	authority string // :authority of request
+	ctype     string // content-type of request
+	status    string // :status of response
+	grpc      string // grpc-status of response
+	message   string // grpc-message of response
+	size      int    // Bytes of response data
+}
+
+// HTTP2Side state of one direction of a connection
+type HTTP2Side struct {
+	decoder *hpack.Decoder // Hpack decoder of the header blocks sent by this side
+	block   []byte         // Header block fragments waiting for CONTINUATION
+	stream  uint32         // Stream of the header block
+	end     bool           // Whether the header block ends the stream
+	push    bool           // Whether the header block is a PUSH_PROMISE, which only updates the dynamic table
+	broken  bool           // Whether the dynamic table is unknown, such as capturing in the middle
+}
+
+// HTTP2Conn state of a http2 connection
+type HTTP2Conn struct {
+	client  *HTTP2Side
+	server  *HTTP2Side
+	streams map[uint32]*HTTP2Stream
+}
+
+// HTTP2Parser http2 and grpc parser, the requests and replies of multiplexed streams
+// are matched by stream id
+type HTTP2Parser struct {
+	conns map[string]*HTTP2Conn // Connections by "client -> server"
+}
+
+// conn find or create the state of connection
+func (h *HTTP2Parser) conn(v *Packet) *HTTP2Conn {
+	if h.conns == nil {
+		h.conns = make(map[string]*HTTP2Conn)
+	}
+
+	id := ConnID(v)
+	c, ok := h.conns[id]
+	if !ok {
+		c = &HTTP2Conn{
+			client:  &HTTP2Side{decoder: hpack.NewDecoder(HTTP2HeaderTableSize, nil)},
+			server:  &HTTP2Side{decoder: hpack.NewDecoder(HTTP2HeaderTableSize, nil)},
+			streams: make(map[uint32]*HTTP2Stream),
+		}
+		h.conns[id] = c
+	}
+
+	return c
+}
+
+// Close release the state of connection
+func (h *HTTP2Parser) Close(v *Packet) {
+	delete(h.conns, ConnID(v))
+}
+
+// Split split the stream into the preface and frames
+func (h *HTTP2Parser) Split(v *Packet, data []byte) (int, bool) {
+	if data[0] == 'P' {
+		n := len(HTTP2Preface)
+		if len(data) < n {
+			if strings.HasPrefix(HTTP2Preface, string(data)) {
+				return 0, false
+			}
+		} else if string(data[:n]) == HTTP2Preface {
+			return n, false
+		}
+	}
+
+	if len(data) < HTTP2FrameHeaderLen {
+		return 0, false
+	}
+	size := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	if size > HTTP2MaxFrameSize {
+		return -1, false
+	}
+
+	return HTTP2FrameHeaderLen + size, false
+}
+
+// Run process the frame, only the complete request headers and the end of
+// reply streams are reported, the other frames are ignored
+func (h *HTTP2Parser) Run(v *Packet) {
+	v.Ignore = true
+	data := []byte(v.Payload)
+	if len(data) < HTTP2FrameHeaderLen {
+		return
+	}
+
+	c := h.conn(v)
+	self, peer := c.server, c.client
+	if v.Request {
+		self, peer = c.client, c.server
+	}
+
+	typ, flags := data[3], data[4]
+	id := binary.BigEndian.Uint32(data[5:9]) & 0x7fffffff
+	payload := data[HTTP2FrameHeaderLen:]
+	switch typ {
+	case HTTP2Settings:
+		// The table size announced by one side limits the encoder of the other side
+		if flags&HTTP2FlagAck != 0 {
+			return
+		}
+		for i := 0; i+6 <= len(payload); i += 6 {
+			if binary.BigEndian.Uint16(payload[i:i+2]) == HTTP2SettingsHeaderTableSize {
+				peer.decoder.SetAllowedMaxDynamicTableSize(binary.BigEndian.Uint32(payload[i+2 : i+6]))
+			}
+		}
+
+	case HTTP2Headers, HTTP2PushPromise:
+		fragment, ok := http2Unpad(payload, flags)
+		skip := 0
+		switch {
+		case typ == HTTP2PushPromise:
+			// Promised stream id
+			skip = 4
+		case flags&HTTP2FlagPriority != 0:
+			skip = 5
+		}
+		if !ok || len(fragment) < skip {
+			// The skipped header block leaves the dynamic table unknown
+			self.block, self.broken = nil, true
+			return
+		}
+		self.block = append(self.block[:0], fragment[skip:]...)
+		self.stream, self.end, self.push = id, flags&HTTP2FlagEndStream != 0, typ == HTTP2PushPromise
+		if flags&HTTP2FlagEndHeaders != 0 {
+			h.headers(c, self, v)
+		}
+
+	case HTTP2Continuation:
+		if id != self.stream || self.block == nil {
+			self.block, self.broken = nil, true
+			return
+		}
+		self.block = append(self.block, payload...)
+		if flags&HTTP2FlagEndHeaders != 0 {
+			h.headers(c, self, v)
+		}
+
+	case HTTP2Data:
+		st := c.streams[id]
+		if st == nil {
+			return
+		}
+		if v.Request {
+			return
+		}
+		st.size += len(payload)
+		if flags&HTTP2FlagEndStream != 0 {
+			h.reply(c, id, v)
+		}
+
+	case HTTP2RstStream:
+		// The stream reset by either side ends with the error code, the reset of client
+		// is reported as the reply of its connection
+		st := c.streams[id]
+		if st == nil || len(payload) < 4 {
+			return
+		}
+		v.Request = false
+		st.status = fmt.Sprintf("RST_STREAM %d", binary.BigEndian.Uint32(payload[:4]))
+		h.reply(c, id, v)
+	}
+}
+
+// headers decode the complete header block, the request is reported once its headers
+// arrive, and the reply is reported when the headers or trailers end the stream
+func (h *HTTP2Parser) headers(c *HTTP2Conn, side *HTTP2Side, v *Packet) {
+	block, id := side.block, side.stream
+	side.block = nil
+	if side.broken {
+		return
+	}
+	fields, e := side.decoder.DecodeFull(block)
+	if e != nil {
+		// The later blocks can not be decoded without the dynamic table
+		side.broken = true
+		return
+	}
+	// The promised requests are not sent by the client
+	if side.push {
+		return
+	}
+
+	if v.Request {
+		st := &HTTP2Stream{}
+		for _, f := range fields {
+			switch f.Name {
+			case ":method":
+				st.method = f.Value
+			case ":path":
+				st.path = f.Value
+			case ":authority":
+				st.authority = f.Value
+			case "content-type":
+				st.ctype = f.Value
+			}
+		}
+		if st.method == "" {
+			// Trailers of the request
+			return
+		}
+		c.streams[id] = st
+
+		v.Ignore = false
+		v.MatchID = strconv.FormatUint(uint64(id), 10)
+		v.Command = fmt.Sprintf("%s %s", st.method, strings.SplitN(st.path, "?", 2)[0])
+		if http2IsGRPC(st.ctype) {
+			v.Command = st.path
+		}
+		v.Content = fmt.Sprintf("[HTTP/2 %s] %s%s stream=%d", st.method, st.authority, st.path, id)
+		if st.ctype != "" {
+			v.Content += fmt.Sprintf(" content-type=%s", strconv.Quote(st.ctype))
+		}
+		return
+	}
+
+	st := c.streams[id]
+	if st == nil {
+		return
+	}
+	for _, f := range fields {
+		switch f.Name {
+		case ":status":
+			st.status = f.Value
+		case "grpc-status":
+			st.grpc = f.Value
+		case "grpc-message":
+			st.message = f.Value
+		}
+	}
+	if side.end {
+		h.reply(c, id, v)
+	}
+}
+
+// reply report the end of the reply stream and release the stream
+func (h *HTTP2Parser) reply(c *HTTP2Conn, id uint32, v *Packet) {
+	st := c.streams[id]
+	delete(c.streams, id)
+
+	v.Ignore = false
+	v.MatchID = strconv.FormatUint(uint64(id), 10)
+	v.PayloadLen = st.size
+	v.Status = st.status
+	if code, e := strconv.Atoi(st.status); e == nil {
+		v.Error = code >= 500
+	} else {
+		v.Error = st.status != ""
+	}
+
+	v.Content = fmt.Sprintf("[HTTP/2 %s] stream=%d length=%d", st.status, id, st.size)
+	if st.grpc != "" {
+		v.Status = st.grpc
+		if code, e := strconv.Atoi(st.grpc); e == nil && code >= 0 && code < len(GRPCStatus) {
+			v.Status = GRPCStatus[code]
+		}
+		v.Error = st.grpc != "0"
+		v.Content += fmt.Sprintf(" grpc-status=%s", v.Status)
+		if st.message != "" {
+			v.Content += fmt.Sprintf(" grpc-message=%s", strconv.Quote(st.message))
+		}
+	}
+}
+
+// http2Unpad strip the padding of frame payload
+func http2Unpad(payload []byte, flags byte) ([]byte, bool) {
+	if flags&HTTP2FlagPadded == 0 {
+		return payload, true
+	}
+	if len(payload) < 1 || int(payload[0]) >= len(payload) {
+		return nil, false
+	}
+
+	return payload[1 : len(payload)-int(payload[0])], true
+}
+
+// http2IsGRPC whether the content type is grpc
+func http2IsGRPC(ctype string) bool {
+	return strings.HasPrefix(ctype, "application/grpc")
+}
@@ -1,31 +1,440 @@
 package parser
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
 	"strings"
 )
 
-// MemcachedParser memcached parser
-type MemcachedParser struct{}
+// Magic bytes of the binary protocol
+const (
+	MemcachedMagicRequest  = 0x80
+	MemcachedMagicResponse = 0x81
+)
+
+// MemcachedHeaderLen length of the binary header
+const MemcachedHeaderLen = 24
+
+// Statuses of the retrieval commands
+const (
+	MemcachedHit     = "HIT"
+	MemcachedMiss    = "MISS"
+	MemcachedPartial = "PARTIAL"
+)
+
+// MemcachedNoReply text commands accepting the trailing noreply
+var MemcachedNoReply = map[string]bool{
+	"set": true, "add": true, "replace": true, "append": true, "prepend": true, "cas": true,
+	"incr": true, "decr": true, "delete": true, "touch": true, "flush_all": true, "verbosity": true,
+}
+
+// MemcachedRetrieval text commands returning values until END, and the position of the first key
+var MemcachedRetrieval = map[string]int{"get": 1, "gets": 1, "gat": 2, "gats": 2}
+
+// MemcachedMeta meta commands, and the reply codes of each one shown in quiet mode
+var MemcachedMeta = map[string][]string{
+	"mg": {"VA", "HD"},
+	"ms": {"NS", "EX", "NF"},
+	"md": {"NF", "EX"},
+	"ma": {"EN", "NF", "NS", "EX"},
+	"mn": nil,
+}
+
+// MemcachedMetaCodes reply codes of the meta commands, which are followed by flags
+var MemcachedMetaCodes = map[string]bool{
+	"VA": true, "HD": true, "EN": true, "NF": true, "NS": true, "EX": true, "MN": true,
+}
+
+// MemcachedOpcodes names of the binary opcodes
+var MemcachedOpcodes = map[byte]string{
+	0x00: "get", 0x01: "set", 0x02: "add", 0x03: "replace", 0x04: "delete",
+	0x05: "incr", 0x06: "decr", 0x07: "quit", 0x08: "flush", 0x09: "getq",
+	0x0a: "noop", 0x0b: "version", 0x0c: "getk", 0x0d: "getkq", 0x0e: "append",
+	0x0f: "prepend", 0x10: "stat", 0x11: "setq", 0x12: "addq", 0x13: "replaceq",
+	0x14: "deleteq", 0x15: "incrq", 0x16: "decrq", 0x17: "quitq", 0x18: "flushq",
+	0x19: "appendq", 0x1a: "prependq", 0x1b: "verbosity", 0x1c: "touch", 0x1d: "gat",
+	0x1e: "gatq", 0x20: "sasl_list_mechs", 0x21: "sasl_auth", 0x22: "sasl_step",
+}
+
+// MemcachedQuietOpcodes binary opcodes whose successful replies (or misses of gets) are suppressed
+var MemcachedQuietOpcodes = map[byte]bool{
+	0x09: true, 0x0d: true, 0x11: true, 0x12: true, 0x13: true, 0x14: true, 0x15: true,
+	0x16: true, 0x17: true, 0x18: true, 0x19: true, 0x1a: true, 0x1e: true,
+}
+
+// MemcachedQuietGets binary quiet gets, whose hits are replied and misses are implied by
+// the next reply of a non-quiet request
+var MemcachedQuietGets = map[byte]bool{0x09: true, 0x0d: true, 0x1e: true}
+
+// MemcachedMaxPending maximum outstanding binary requests tracked for the quiet gets
+const MemcachedMaxPending = 1024
+
+// MemcachedStatuses names of the binary reply statuses
+var MemcachedStatuses = map[uint16]string{
+	0x00: "OK", 0x01: "NOT_FOUND", 0x02: "EXISTS", 0x03: "TOO_LARGE", 0x04: "INVALID_ARGUMENTS",
+	0x05: "NOT_STORED", 0x06: "NON_NUMERIC", 0x07: "NOT_MY_VBUCKET", 0x08: "AUTH_ERROR",
+	0x09: "AUTH_CONTINUE", 0x81: "UNKNOWN_COMMAND", 0x82: "OUT_OF_MEMORY", 0x83: "NOT_SUPPORTED",
+	0x84: "INTERNAL_ERROR", 0x85: "BUSY", 0x86: "TEMPORARY_FAILURE",
+}
+
+// MemcachedRequest outstanding text request waiting for its reply
+type MemcachedRequest struct {
+	command string // Command name
+	keys    int    // Number of keys of retrieval commands
+	quiet   bool   // Whether the meta command is in quiet mode
+	opaque  string // Opaque token of the meta command
+}
+
+// MemcachedConn state of a memcached connection
+type MemcachedConn struct {
+	pending []*MemcachedRequest // Outstanding text requests in order
+	binary  []*MemcachedRequest // Outstanding binary requests in order
+}
+
+// MemcachedParser memcached parser of the text, meta and binary protocols
+type MemcachedParser struct {
+	conns map[string]*MemcachedConn // Connections by "client -> server"
+}
+
+// conn find or create the state of connection
+func (m *MemcachedParser) conn(v *Packet) *MemcachedConn {
+	if m.conns == nil {
+		m.conns = make(map[string]*MemcachedConn)
+	}
+
+	id := ConnID(v)
+	c, ok := m.conns[id]
+	if !ok {
+		c = &MemcachedConn{}
+		m.conns[id] = c
+	}
+
+	return c
+}
 
-// NoReplyCommands no reply commands
-var NoReplyCommands = []string{
-	"get", "gets", "stats", "stat", "watch", "lru",
-	"set", "add", "incr", "decr", "delete", "replace",
-	"append", "prepend", "cas", "touch", "flushall",
+// Close release the state of connection
+func (m *MemcachedParser) Close(v *Packet) {
+	delete(m.conns, ConnID(v))
 }
 
 // Run parse packets
 func (m *MemcachedParser) Run(v *Packet) {
-	p := v.Payload
+	if len(v.Payload) > 0 && (v.Payload[0] == MemcachedMagicRequest || v.Payload[0] == MemcachedMagicResponse) {
+		m.binary(v)
+		return
+	}
+
+	v.Content = strings.ReplaceAll(v.Payload, "\r\n", " ")
+	line := v.Payload
+	if i := strings.Index(line, "\r\n"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+
+	c := m.conn(v)
+	if v.Request {
+		m.request(c, v, fields)
+	} else {
+		m.reply(c, v, fields)
+	}
+}
+
+// request parse the text request, the ones with noreply are ignored, and the quiet
+// meta commands are only tracked for their failures
+func (m *MemcachedParser) request(c *MemcachedConn, v *Packet, fields []string) {
+	cmd := fields[0]
+	v.Command = cmd
+	if MemcachedNoReply[cmd] && fields[len(fields)-1] == "noreply" {
+		v.Ignore = true
+		return
+	}
+
+	r := &MemcachedRequest{command: cmd}
+	if pos, ok := MemcachedRetrieval[cmd]; ok && len(fields) > pos {
+		r.keys = len(fields) - pos
+	}
+	if _, ok := MemcachedMeta[cmd]; ok {
+		// The flags follow the key, and the data length of ms
+		pos := 2
+		switch cmd {
+		case "mn":
+			pos = 1
+		case "ms":
+			pos = 3
+		}
+		if len(fields) > pos {
+			r.quiet, r.opaque = memcachedFlags(fields[pos:])
+		}
+		if r.opaque != "" {
+			v.MatchID = r.opaque
+		}
+		v.Ignore = r.quiet
+	}
+	c.pending = append(c.pending, r)
+}
+
+// reply parse the text reply and classify the retrievals into hit or miss
+func (m *MemcachedParser) reply(c *MemcachedConn, v *Packet, fields []string) {
+	code := fields[0]
+	v.Status = code
+	v.Error = strings.HasSuffix(code, "ERROR")
+	if _, e := strconv.ParseUint(code, 10, 64); e == nil {
+		// Value of incr and decr
+		v.Status = "OK"
+	}
+
+	opaque := ""
+	if MemcachedMetaCodes[code] {
+		_, opaque = memcachedFlags(fields[1:])
+	}
+	if opaque != "" {
+		v.MatchID = opaque
+	}
+	r := c.match(code, opaque)
+	if r == nil {
+		return
+	}
+	if r.quiet {
+		v.Ignore = true
+		return
+	}
+
+	switch {
+	case r.keys > 0:
+		v.Rows = int64(strings.Count("\r\n"+v.Payload, "\r\nVALUE "))
+		switch {
+		case v.Rows == 0:
+			v.Status = MemcachedMiss
+		case v.Rows < int64(r.keys):
+			v.Status = MemcachedPartial
+		default:
+			v.Status = MemcachedHit
+		}
+	case r.command == "mg" && (code == "VA" || code == "HD"):
+		v.Status, v.Rows = MemcachedHit, 1
+	case r.command == "mg" && code == "EN":
+		v.Status = MemcachedMiss
+	}
+}
+
+// match dequeue the request of the reply, which is the one with the same opaque token or
+// the oldest one, the quiet requests before it have succeeded without replies
+func (c *MemcachedConn) match(code, opaque string) *MemcachedRequest {
+	for i, r := range c.pending {
+		if opaque != "" && r.opaque != opaque || opaque == "" && r.quiet && !memcachedShown(r.command, code) {
+			continue
+		}
+		rest := c.pending[:0]
+		for _, o := range c.pending[:i] {
+			if !o.quiet {
+				rest = append(rest, o)
+			}
+		}
+		c.pending = append(rest, c.pending[i+1:]...)
+		return r
+	}
+	if opaque == "" {
+		c.pending = nil
+	}
+
+	return nil
+}
+
+// binary parse the binary request or reply, which is matched by the opaque, the
+// quiet requests and their replies are ignored except the quiet gets
+func (m *MemcachedParser) binary(v *Packet) {
+	p := []byte(v.Payload)
+	if len(p) < MemcachedHeaderLen {
+		v.Content = fmt.Sprintf("%q", v.Payload)
+		return
+	}
 
-	for index, cmd := range NoReplyCommands {
-		if strings.LastIndex(p, cmd) == 0 {
-			if index >= 6 && len(p) > 7 && strings.Contains(p[7:], "noreply") {
-				v.Ignore = true
-				return
+	opcode := p[1]
+	klen, elen := int(binary.BigEndian.Uint16(p[2:4])), int(p[4])
+	status := binary.BigEndian.Uint16(p[6:8])
+	body := int(binary.BigEndian.Uint32(p[8:12]))
+	// Only the head of a long value may be kept in payload
+	if elen+klen > body || MemcachedHeaderLen+elen+klen > len(p) {
+		body = len(p) - MemcachedHeaderLen
+		elen, klen = 0, 0
+	}
+	key := string(p[MemcachedHeaderLen+elen : MemcachedHeaderLen+elen+klen])
+	value := body - elen - klen
+
+	name, ok := MemcachedOpcodes[opcode]
+	if !ok {
+		name = fmt.Sprintf("0x%02x", opcode)
+	}
+	v.Request = p[0] == MemcachedMagicRequest
+	v.MatchID = strconv.FormatUint(uint64(binary.BigEndian.Uint32(p[12:16])), 10)
+	v.Ignore = MemcachedQuietOpcodes[opcode] && !MemcachedQuietGets[opcode]
+	if v.Request {
+		v.Command = name
+		v.Content = fmt.Sprintf("[binary %s] %s length=%d", name, key, value)
+		if !v.Ignore {
+			m.conn(v).push(&MemcachedRequest{command: name, quiet: MemcachedQuietGets[opcode], opaque: v.MatchID})
+		}
+		return
+	}
+	if !v.Ignore {
+		m.conn(v).implied(v, MemcachedQuietGets[opcode])
+	}
+
+	v.Status, ok = MemcachedStatuses[status]
+	if !ok {
+		v.Status = fmt.Sprintf("0x%04x", status)
+	}
+	v.Error = status >= 0x81 || status == 0x03 || status == 0x04 || status == 0x06 || status == 0x07 || status == 0x08
+	v.Content = fmt.Sprintf("[binary %s %s] %s length=%d", name, v.Status, key, value)
+	switch name {
+	case "get", "getk", "gat", "getq", "getkq", "gatq":
+		if status == 0x00 {
+			v.Status, v.Rows = MemcachedHit, 1
+		} else if status == 0x01 {
+			v.Status = MemcachedMiss
+		}
+	}
+}
+
+// push track the binary request, the oldest ones lost their replies once too many are outstanding
+func (c *MemcachedConn) push(r *MemcachedRequest) {
+	if len(c.binary) >= MemcachedMaxPending {
+		c.binary = c.binary[1:]
+	}
+	c.binary = append(c.binary, r)
+}
+
+// implied dequeue the binary request of the reply, the quiet gets before the request
+// of a non-quiet reply are missed and their replies are implied by it
+func (c *MemcachedConn) implied(v *Packet, quiet bool) {
+	for i, r := range c.binary {
+		if r.opaque != v.MatchID {
+			continue
+		}
+		if quiet {
+			c.binary = append(c.binary[:i], c.binary[i+1:]...)
+			return
+		}
+
+		for _, o := range c.binary[:i] {
+			if !o.quiet {
+				continue
 			}
+			miss := *v
+			miss.MatchID, miss.Status, miss.Error, miss.Rows, miss.Implied = o.opaque, MemcachedMiss, false, 0, nil
+			miss.Content = fmt.Sprintf("[binary %s %s]", o.command, MemcachedMiss)
+			miss.Payload, miss.PayloadLen = "", 0
+			v.Implied = append(v.Implied, &miss)
 		}
+		c.binary = c.binary[i+1:]
+		return
 	}
+}
 
-	v.Content = strings.ReplaceAll(v.Payload, "\r\n", " ")
+// Split split the stream by the command lines and data blocks, or by the binary headers,
+// the retrieval and stats replies are framed line by line until END
+func (m *MemcachedParser) Split(v *Packet, data []byte) (int, bool) {
+	if data[0] == MemcachedMagicRequest || data[0] == MemcachedMagicResponse {
+		return memcachedBinary(data)
+	}
+
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(string(data[:end]))
+	if len(fields) == 0 {
+		return end + 2, false
+	}
+
+	// Storage commands carry a data block
+	if v.Request {
+		switch fields[0] {
+		case "set", "add", "replace", "append", "prepend", "cas":
+			if len(fields) < 5 {
+				return end + 2, false
+			}
+			return memcachedBlock(end, fields[4]), false
+		case "ms":
+			if len(fields) < 3 {
+				return end + 2, false
+			}
+			return memcachedBlock(end, fields[2]), false
+		}
+		return end + 2, false
+	}
+
+	// Retrieval and stats replies last until END
+	switch fields[0] {
+	case "VA":
+		if len(fields) < 2 {
+			return end + 2, false
+		}
+		return memcachedBlock(end, fields[1]), false
+	case "VALUE":
+		if len(fields) < 4 {
+			return end + 2, true
+		}
+		return memcachedBlock(end, fields[3]), true
+	case "STAT", "ITEM":
+		return end + 2, true
+	}
+
+	return end + 2, false
+}
+
+// memcachedBlock return the length of the command line ending at end with its data block
+func memcachedBlock(end int, v string) int {
+	size, err := strconv.Atoi(v)
+	if err != nil || size < 0 {
+		return -1
+	}
+
+	return end + 2 + size + 2
+}
+
+// memcachedBinary return the length of the binary packet, and whether it is a stat
+// reply followed by the others until the one with empty key
+func memcachedBinary(data []byte) (int, bool) {
+	if len(data) < MemcachedHeaderLen {
+		return 0, false
+	}
+	klen, elen := int(binary.BigEndian.Uint16(data[2:4])), int(data[4])
+	body := int(binary.BigEndian.Uint32(data[8:12]))
+	if elen+klen > body {
+		return -1, false
+	}
+
+	return MemcachedHeaderLen + body, data[0] == MemcachedMagicResponse && data[1] == 0x10 && klen != 0
+}
+
+// memcachedFlags return whether the meta flags contain the quiet mode, and the opaque token
+func memcachedFlags(flags []string) (bool, string) {
+	quiet, opaque := false, ""
+	for _, f := range flags {
+		switch {
+		case f == "q":
+			quiet = true
+		case len(f) > 1 && f[0] == 'O':
+			opaque = f[1:]
+		}
+	}
+
+	return quiet, opaque
+}
+
+// memcachedShown whether the reply code is shown for the meta command in quiet mode
+func memcachedShown(command, code string) bool {
+	for _, v := range MemcachedMeta[command] {
+		if v == code {
+			return true
+		}
+	}
+
+	return false
 }
@@ -1,23 +1,382 @@
 package parser
 
 import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"strings"
 )
 
+/* MongoDB wire protocol message format
+
+https://docs.mongodb.com/manual/reference/mongodb-wire-protocol/
+
++---------------+---------------+---------------+---------------+------------+
+|    4 Bytes    |    4 Bytes    |    4 Bytes    |    4 Bytes    |  N Bytes   |
++---------------+---------------+---------------+---------------+------------+
+| messageLength |   requestID   |  responseTo   |    opCode     |    body    |
++---------------+---------------+---------------+---------------+------------+
+*/
+
+// MongoDB operation codes
+const (
+	MongoOpReply      = 1
+	MongoOpUpdate     = 2001
+	MongoOpInsert     = 2002
+	MongoOpQuery      = 2004
+	MongoOpGetMore    = 2005
+	MongoOpDelete     = 2006
+	MongoOpKillCursor = 2007
+	MongoOpCompressed = 2012
+	MongoOpMsg        = 2013
+)
+
+// MongoDB OP_MSG flag bits
+const (
+	MongoMsgChecksum   = 1 << 0
+	MongoMsgMoreToCome = 1 << 1
+)
+
+// MongoDB compressors of OP_COMPRESSED
+const (
+	MongoCompressorNoop   = 0
+	MongoCompressorSnappy = 1
+	MongoCompressorZlib   = 2
+	MongoCompressorZstd   = 3
+)
+
+// MongoMaxMessage maximum size of a message
+const MongoMaxMessage = 48 << 20
+
+// MongoHeaderSize size of the standard message header
+const MongoHeaderSize = 16
+
+// MongoContentSize maximum length of the rendered command
+const MongoContentSize = 1024
+
+// MongoSkipKeys keys of the session and cluster information hidden in content
+var MongoSkipKeys = []string{"$db", "lsid", "$clusterTime", "$readPreference", "txnNumber", "signature"}
+
 // MongoDBParser mongodb parser
 type MongoDBParser struct{}
 
+// Split split the stream by the length in message header
+func (m *MongoDBParser) Split(v *Packet, data []byte) (int, bool) {
+	if len(data) < 4 {
+		return 0, false
+	}
+
+	size := int(int32(binary.LittleEndian.Uint32(data)))
+	if size < MongoHeaderSize || size > MongoMaxMessage {
+		return -1, false
+	}
+
+	return size, false
+}
+
 // Run parse packets
 func (m *MongoDBParser) Run(v *Packet) {
-	var cmds []string
+	p := []byte(v.Payload)
+	if len(p) < MongoHeaderSize {
+		v.Ignore = true
+		return
+	}
+
+	reqid := int32(binary.LittleEndian.Uint32(p[4:]))
+	rspto := int32(binary.LittleEndian.Uint32(p[8:]))
+	opcode := int32(binary.LittleEndian.Uint32(p[12:]))
+	body := p[MongoHeaderSize:]
+
+	// Replies are matched by responseTo instead of the order on connection
+	if rspto != 0 {
+		v.Request = false
+		v.MatchID = fmt.Sprintf("%d", rspto)
+	} else {
+		v.Request = true
+		v.MatchID = fmt.Sprintf("%d", reqid)
+	}
+
+	m.dispatch(v, opcode, body)
+}
+
+// dispatch decode the message body by operation code
+func (m *MongoDBParser) dispatch(v *Packet, opcode int32, body []byte) {
+	switch opcode {
+	case MongoOpMsg:
+		m.msg(v, body)
+	case MongoOpQuery:
+		m.query(v, body)
+	case MongoOpReply:
+		m.reply(v, body)
+	case MongoOpCompressed:
+		m.compressed(v, body)
+	default:
+		v.Command = mongoOpName(opcode)
+		v.Content = v.Command
+		// Legacy write operations have no reply
+		switch opcode {
+		case MongoOpUpdate, MongoOpInsert, MongoOpDelete, MongoOpKillCursor:
+			v.Ignore = true
+		}
+	}
+}
+
+// compressed decode OP_COMPRESSED, only noop and zlib compressors are supported
+func (m *MongoDBParser) compressed(v *Packet, p []byte) {
+	if len(p) < 9 {
+		v.Ignore = true
+		return
+	}
+
+	opcode := int32(binary.LittleEndian.Uint32(p))
+	size := int(int32(binary.LittleEndian.Uint32(p[4:])))
+	v.Command = mongoOpName(opcode)
+	if size < 0 || size > MongoMaxMessage {
+		v.Content = fmt.Sprintf("uncompressed size %d is illegal", size)
+		return
+	}
+
+	var body []byte
+	switch p[8] {
+	case MongoCompressorNoop:
+		body = p[9:]
+	case MongoCompressorZlib:
+		r, err := zlib.NewReader(bytes.NewReader(p[9:]))
+		if err != nil {
+			v.Content = err.Error()
+			return
+		}
+		defer r.Close()
+		body = make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			v.Content = err.Error()
+			return
+		}
+	default:
+		v.Content = fmt.Sprintf("compressed by unsupported compressor %d", p[8])
+		return
+	}
+
+	m.dispatch(v, opcode, body)
+}
+
+// msg decode OP_MSG with the body section and document sequences
+func (m *MongoDBParser) msg(v *Packet, p []byte) {
+	if len(p) < 5 {
+		v.Ignore = true
+		return
+	}
+
+	flags := binary.LittleEndian.Uint32(p)
+	end := len(p)
+	if flags&MongoMsgChecksum != 0 {
+		end -= 4
+	}
+
+	var body []*BSONElem
+	var seqs []string
+	for pos := 4; pos < end; {
+		kind := p[pos]
+		pos++
+		switch kind {
+		case 0:
+			elems, n, err := BSONDoc(p[pos:end])
+			if err != nil {
+				v.Content = err.Error()
+				return
+			}
+			body = elems
+			pos += n
+		case 1:
+			if end < pos+4 {
+				return
+			}
+			size := int(int32(binary.LittleEndian.Uint32(p[pos:])))
+			if size < 4 || end < pos+size {
+				return
+			}
+			id, _ := cstring(p[:pos+size], pos+4)
+			seqs = append(seqs, id)
+			pos += size
+		default:
+			v.Content = fmt.Sprintf("unknown section kind %d", kind)
+			return
+		}
+	}
+
+	if v.Request {
+		// The requester will not wait for a reply
+		if flags&MongoMsgMoreToCome != 0 {
+			v.Ignore = true
+		}
+		m.command(v, body, "")
+		if len(seqs) > 0 {
+			v.Content += fmt.Sprintf(" +%s", strings.Join(seqs, ","))
+		}
+		return
+	}
+
+	m.result(v, body)
+}
+
+// query decode the legacy OP_QUERY
+func (m *MongoDBParser) query(v *Packet, p []byte) {
+	if len(p) < 4 {
+		return
+	}
+
+	name, pos := cstring(p, 4)
+	pos += 8 // numberToSkip, numberToReturn
+	if pos > len(p) {
+		return
+	}
+	elems, _, err := BSONDoc(p[pos:])
+	if err != nil {
+		v.Content = err.Error()
+		return
+	}
+
+	// Commands are queries on the "<db>.$cmd" collection
+	db, coll := name, ""
+	if i := strings.Index(name, "."); i >= 0 {
+		db, coll = name[:i], name[i+1:]
+	}
+	if coll != "$cmd" {
+		v.Command = "query"
+		v.Database = db
+		v.Content = fmt.Sprintf("%s %s", name, mongoTruncate(BSONText(elems, false, MongoSkipKeys...)))
+		return
+	}
+
+	// Command may be wrapped in $query
+	if q := bsonFind(elems, "$query"); q != nil && q.Type == BSONDocument {
+		if inner, _, err := BSONDoc(q.Value); err == nil {
+			elems = inner
+		}
+	}
+	m.command(v, elems, db)
+}
+
+// reply decode the legacy OP_REPLY
+func (m *MongoDBParser) reply(v *Packet, p []byte) {
+	if len(p) < 20 {
+		return
+	}
+
+	flags := binary.LittleEndian.Uint32(p)
+	returned := int32(binary.LittleEndian.Uint32(p[16:]))
+	v.Rows = int64(returned)
+
+	// Query failure flag
+	if flags&0x02 != 0 {
+		v.Error = true
+		v.Status = "error"
+	}
+	if returned == 1 {
+		if elems, _, err := BSONDoc(p[20:]); err == nil {
+			m.result(v, elems)
+			return
+		}
+	}
+	if !v.Error {
+		v.Status = "ok"
+	}
+	v.Content = fmt.Sprintf("%d documents", returned)
+}
+
+// command report the command name, database and collection
+func (m *MongoDBParser) command(v *Packet, elems []*BSONElem, db string) {
+	if len(elems) == 0 {
+		return
+	}
+
+	v.Command = elems[0].Key
+	if e := bsonFind(elems, "$db"); e != nil {
+		db = e.String()
+	}
+	v.Database = db
+
+	// The collection is the value of command name, or the field of getMore
+	coll := elems[0].String()
+	if e := bsonFind(elems, "collection"); e != nil && coll == "" {
+		coll = e.String()
+	}
+
+	name := db
+	if coll != "" {
+		name = fmt.Sprintf("%s.%s", db, coll)
+	}
+	v.Content = fmt.Sprintf("%s %s", name, mongoTruncate(BSONText(elems, false, MongoSkipKeys...)))
+}
+
+// result classify the reply document
+func (m *MongoDBParser) result(v *Packet, elems []*BSONElem) {
+	v.Status = "ok"
+	if ok := bsonFind(elems, "ok"); ok != nil && ok.Int() == 0 {
+		v.Status, v.Error = "error", true
+		if code := bsonFind(elems, "codeName"); code != nil {
+			v.Status = code.String()
+		}
+	}
+	if e := bsonFind(elems, "$err"); e != nil {
+		v.Status, v.Error = "error", true
+	}
 
-	p := v.Payload
-	if len(p) > 0 && p[:1] == "*" {
-		lines := strings.Split(p, "\r\n")
-		for i := 2; i < len(lines); i += 2 {
-			cmds = append(cmds, lines[i])
+	// Affected documents of writes, or the first batch of cursor
+	if n := bsonFind(elems, "n"); n != nil {
+		v.Rows = n.Int()
+	}
+	if c := bsonFind(elems, "cursor"); c != nil && c.Type == BSONDocument {
+		if cursor, _, err := BSONDoc(c.Value); err == nil {
+			for _, key := range []string{"firstBatch", "nextBatch"} {
+				if b := bsonFind(cursor, key); b != nil && b.Type == BSONArray {
+					docs, _, _ := BSONDoc(b.Value)
+					v.Rows = int64(len(docs))
+				}
+			}
 		}
 	}
 
-	v.Content = strings.Join(cmds, " ")
+	if msg := bsonFind(elems, "errmsg"); msg != nil {
+		v.Content = msg.String()
+		return
+	}
+	v.Content = mongoTruncate(BSONText(elems, false, "$clusterTime", "operationTime", "signature"))
+}
+
+// mongoOpName name of the operation code
+func mongoOpName(op int32) string {
+	switch op {
+	case MongoOpReply:
+		return "OP_REPLY"
+	case MongoOpUpdate:
+		return "OP_UPDATE"
+	case MongoOpInsert:
+		return "OP_INSERT"
+	case MongoOpQuery:
+		return "OP_QUERY"
+	case MongoOpGetMore:
+		return "OP_GET_MORE"
+	case MongoOpDelete:
+		return "OP_DELETE"
+	case MongoOpKillCursor:
+		return "OP_KILL_CURSORS"
+	case MongoOpCompressed:
+		return "OP_COMPRESSED"
+	case MongoOpMsg:
+		return "OP_MSG"
+	}
+
+	return fmt.Sprintf("OP_%d", op)
+}
+
+// mongoTruncate truncate the long content
+func mongoTruncate(v string) string {
+	if len(v) > MongoContentSize {
+		return v[:MongoContentSize] + "..."
+	}
+
+	return v
 }
@@ -1,5 +1,12 @@
 package parser
 
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
 /* Mysql protocol packet format
 
 https://dev.mysql.com/doc/dev/mysql-server/8.0.11/page_protocol_basic_packets.html#sect_protocol_basic_packets_packet
@@ -45,6 +52,10 @@ const (
 	MySQLStmtReset        = 0x1A // 26, mysql_stmt_reset
 	MySQLSetOption        = 0x1B // 27, mysql_set_server_option
 	MySQLStmtFetch        = 0x1C // 28, mysql_stmt_fetch
+	MySQLLogin            = 0xF0 // pseudo command of the handshake response
+	MySQLAuth             = 0xF1 // pseudo command of the other packets while authenticating
+	MySQLUnknown          = 0xF2 // pseudo command of the responses without known request
+	MySQLTrailer          = 0xF3 // pseudo command of the EOF trailing a response of unknown capabilities
 	// MySQLDaemon          = 29
 	// MySQLBinglogDumpGitd = 29
 	// MySQLResetConnection = 31
@@ -52,6 +63,40 @@ const (
 	// MySQL0x00            = 0x00
 )
 
+// MySQLCommands names of the client request types
+var MySQLCommands = map[byte]string{
+	MySQLSleep:            "SLEEP",
+	MySQLQuit:             "QUIT",
+	MySQLInitDB:           "INIT_DB",
+	MySQLQuery:            "QUERY",
+	MySQLFieldList:        "FIELD_LIST",
+	MySQLCreateDB:         "CREATE_DB",
+	MySQLDropDB:           "DROP_DB",
+	MySQLRefresh:          "REFRESH",
+	MySQLShutdown:         "SHUTDOWN",
+	MySQLStatistics:       "STATISTICS",
+	MySQLProcessInfo:      "PROCESS_INFO",
+	MySQLConnect:          "CONNECT",
+	MySQLProcessKill:      "PROCESS_KILL",
+	MySQLDebug:            "DEBUG",
+	MySQLPing:             "PING",
+	MySQLTime:             "TIME",
+	MySQLDelayedInsert:    "DELAYED_INSERT",
+	MySQLChangeUser:       "CHANGE_USER",
+	MySQLBinglogDump:      "BINLOG_DUMP",
+	MySQLTableDump:        "TABLE_DUMP",
+	MySQLConnectOut:       "CONNECT_OUT",
+	MySQLRegisterSlave:    "REGISTER_SLAVE",
+	MySQLStmtPrepare:      "STMT_PREPARE",
+	MySQLStmtExecute:      "STMT_EXECUTE",
+	MySQLStmtSendLongData: "STMT_SEND_LONG_DATA",
+	MySQLStmtClose:        "STMT_CLOSE",
+	MySQLStmtReset:        "STMT_RESET",
+	MySQLSetOption:        "SET_OPTION",
+	MySQLStmtFetch:        "STMT_FETCH",
+	MySQLLogin:            "LOGIN",
+}
+
 // Mysql server response type in payload body
 const (
 	MySQLOK    = 0x00
@@ -62,59 +107,861 @@ const (
 	// RowData   = 0x01 - 0xFA
 )
 
+// Mysql capability flags
+const (
+	MySQLClientConnectWithDB  = 0x00000008
+	MySQLClientProtocol41     = 0x00000200
+	MySQLClientSSL            = 0x00000800
+	MySQLClientSecureConn     = 0x00008000
+	MySQLClientAuthLenencData = 0x00200000
+	MySQLClientDeprecateEOF   = 0x01000000
+)
+
+// Mysql status flags of OK and EOF packets
+const (
+	MySQLServerMoreResults  = 0x0008 // Following result sets
+	MySQLServerCursorExists = 0x0040 // Rows of the result set are fetched by COM_STMT_FETCH
+)
+
+// MySQLMaxPacket payload length of a packet continued by the next one
+const MySQLMaxPacket = 0xFFFFFF
+
+// MySQLPeekSize bytes at the start of payload needed to frame a packet
+const MySQLPeekSize = 32
+
+// Phases of the response being framed
+const (
+	MySQLPhaseResult = iota // First packet of a result
+	MySQLPhaseDefs          // Parameter or column definitions
+	MySQLPhaseEOF           // EOF following the definitions
+	MySQLPhaseRows          // Rows until the terminator
+	MySQLPhaseFields        // Column definitions of COM_FIELD_LIST until EOF
+)
+
+// Mysql column types in binary protocol
+const (
+	MySQLTypeTiny      = 0x01
+	MySQLTypeShort     = 0x02
+	MySQLTypeLong      = 0x03
+	MySQLTypeFloat     = 0x04
+	MySQLTypeDouble    = 0x05
+	MySQLTypeNull      = 0x06
+	MySQLTypeTimestamp = 0x07
+	MySQLTypeLongLong  = 0x08
+	MySQLTypeInt24     = 0x09
+	MySQLTypeDate      = 0x0A
+	MySQLTypeTime      = 0x0B
+	MySQLTypeDatetime  = 0x0C
+	MySQLTypeYear      = 0x0D
+	MySQLTypeUnsigned  = 0x8000
+)
+
+// MySQLStmt prepared statement
+type MySQLStmt struct {
+	query  string         // Original sql
+	params int            // Number of parameters
+	types  []uint16       // Parameter types bound by the last execution
+	long   map[int][]byte // Parameters sent by COM_STMT_SEND_LONG_DATA
+}
+
+// MySQLConn state of a mysql connection
+type MySQLConn struct {
+	user     string                // Username from the handshake
+	schema   string                // Default schema
+	caps     uint32                // Capability flags of server, then the negotiated flags
+	auth     bool                  // In the authentication phase
+	login    bool                  // Handshake response was sent
+	tls      bool                  // Switched to ssl, the payload is not readable
+	reqs     []byte                // Kinds of the framed requests waiting to be decoded
+	cmds     []byte                // Commands waiting for their responses
+	rsps     []*MySQLResult        // Framed responses waiting to be decoded
+	rsp      *MySQLResult          // Response being framed
+	large    [2]bool               // Whether the payload of request and response continues in the next packet
+	flight   [2]bool               // Whether the last framed request and response are being received
+	trailer  bool                  // Whether an EOF may trail the last response
+	prepares []string              // Sql waiting for COM_STMT_PREPARE_OK
+	stmts    map[uint32]*MySQLStmt // Prepared statements by id
+}
+
+// MySQLResult summary of a response, which is framed packet by packet
+type MySQLResult struct {
+	cmd   byte   // Command of the response
+	phase int    // Phase of the next packet
+	defs  []int  // Definitions in the blocks left, each block may be followed by EOF
+	rows  int64  // Rows of the result sets
+	err   []byte // Payload of the ERR packet ending the response
+}
+
 // MySQLParser mysql parser
-type MySQLParser struct{}
+type MySQLParser struct {
+	conns map[string]*MySQLConn // Connections by "client -> server"
+}
+
+// conn find or create the state of connection
+func (m *MySQLParser) conn(v *Packet) *MySQLConn {
+	if m.conns == nil {
+		m.conns = make(map[string]*MySQLConn)
+	}
+
+	id := ConnID(v)
+	c, ok := m.conns[id]
+	if !ok {
+		c = &MySQLConn{stmts: make(map[uint32]*MySQLStmt)}
+		m.conns[id] = c
+	}
+
+	return c
+}
+
+// Close release the state of connection
+func (m *MySQLParser) Close(v *Packet) {
+	delete(m.conns, ConnID(v))
+}
+
+// Reset drop the message being framed in the direction of v, the response being framed
+// has taken its command already
+func (m *MySQLParser) Reset(v *Packet) {
+	c := m.conn(v)
+	side := mysqlSide(v)
+	if c.flight[side] {
+		if v.Request && len(c.reqs) > 0 {
+			c.reqs = c.reqs[:len(c.reqs)-1]
+		}
+		if !v.Request && len(c.rsps) > 0 {
+			c.rsps = c.rsps[:len(c.rsps)-1]
+		}
+	}
+	c.large[side], c.flight[side] = false, false
+	if !v.Request {
+		c.rsp, c.trailer = nil, false
+	}
+}
+
+// Split split the stream into packets, the packets of a response are the parts of it
+func (m *MySQLParser) Split(v *Packet, data []byte) (int, bool) {
+	c := m.conn(v)
+	if c.tls {
+		return len(data), false
+	}
+
+	payload, end := mysqlPeek(data, 0)
+	if end == 0 {
+		return 0, false
+	}
+	side := mysqlSide(v)
+	size := end - 4
+	if c.large[side] {
+		// Rest of the payload continued from the previous packet
+		c.large[side] = size == MySQLMaxPacket
+		more := c.large[side] || !v.Request && c.rsp != nil
+		c.flight[side] = more || end > len(data)
+		return end, more
+	}
+	// The message of ERR packet is decoded as a whole
+	if !v.Request && len(payload) > 0 && payload[0] == MySQLError && end > len(data) {
+		return 0, false
+	}
+	c.large[side] = size == MySQLMaxPacket
+
+	more := false
+	if v.Request {
+		c.request(payload, size)
+	} else {
+		more = c.response(data, payload, size)
+	}
+	more = more || c.large[side]
+	c.flight[side] = more || end > len(data)
+
+	return end, more
+}
+
+// request track the kind of the request and the command waiting for response
+func (c *MySQLConn) request(payload []byte, size int) {
+	switch {
+	case c.auth && !c.login:
+		caps := uint32(0)
+		if len(payload) >= 4 {
+			caps = binary.LittleEndian.Uint32(payload)
+		}
+		// SSL request is a truncated handshake response
+		if size == 32 && caps&MySQLClientSSL != 0 {
+			c.tls = true
+			c.reqs = append(c.reqs, MySQLAuth)
+			return
+		}
+		c.login = true
+		c.reqs = append(c.reqs, MySQLLogin)
+		c.cmds = append(c.cmds, MySQLLogin)
+	case c.auth, len(payload) == 0:
+		c.reqs = append(c.reqs, MySQLAuth)
+	default:
+		c.reqs = append(c.reqs, payload[0])
+		switch payload[0] {
+		case MySQLQuit, MySQLStmtSendLongData, MySQLStmtClose, MySQLBinglogDump:
+		default:
+			c.cmds = append(c.cmds, payload[0])
+		}
+	}
+}
+
+// response frame the packet of response, return whether the response continues
+func (c *MySQLConn) response(data, payload []byte, size int) bool {
+	if c.rsp != nil {
+		if c.next(c.rsp, payload, size) {
+			c.rsp = nil
+		}
+		return c.rsp != nil
+	}
+
+	// Only the initial handshake is sent by server with sequence 0
+	if data[3] == 0 && len(payload) > 0 && payload[0] == 0x0A {
+		*c = MySQLConn{auth: true, stmts: make(map[uint32]*MySQLStmt)}
+		c.rsps = append(c.rsps, &MySQLResult{cmd: MySQLAuth})
+		return false
+	}
+
+	if c.auth {
+		if len(payload) > 0 && (payload[0] == MySQLOK || payload[0] == MySQLError) {
+			c.auth = false
+			if c.login {
+				c.rsps = append(c.rsps, &MySQLResult{cmd: MySQLLogin})
+				if len(c.cmds) > 0 {
+					c.cmds = c.cmds[1:]
+				}
+				return false
+			}
+		}
+		c.rsps = append(c.rsps, &MySQLResult{cmd: MySQLAuth})
+		return false
+	}
+
+	// The EOF after the definitions of a prepared statement is not known to be sent
+	// without the capabilities of handshake
+	trailer := c.trailer
+	c.trailer = false
+	if trailer && size == 5 && payload[0] == MySQLEOF {
+		c.rsps = append(c.rsps, &MySQLResult{cmd: MySQLTrailer})
+		return false
+	}
+
+	r := &MySQLResult{cmd: MySQLUnknown}
+	if len(c.cmds) > 0 {
+		r.cmd, c.cmds = c.cmds[0], c.cmds[1:]
+	}
+	c.rsps = append(c.rsps, r)
+	if c.next(r, payload, size) {
+		return false
+	}
+	c.rsp = r
+
+	return true
+}
+
+// next frame the packet of the response by its phase, return whether the response ends
+func (c *MySQLConn) next(r *MySQLResult, p []byte, size int) bool {
+	if len(p) == 0 {
+		return r.phase == MySQLPhaseResult
+	}
+
+	switch r.phase {
+	case MySQLPhaseResult:
+		switch {
+		case p[0] == MySQLError:
+			r.err = append([]byte(nil), p...)
+			return true
+		case r.cmd == MySQLStmtFetch:
+			// The rows of cursor are sent without the column definitions
+			r.phase = MySQLPhaseRows
+			return c.next(r, p, size)
+		case p[0] == MySQLOK && r.cmd == MySQLStmtPrepare && len(p) >= 9:
+			// Parameter and column definitions follow COM_STMT_PREPARE_OK
+			for _, n := range []int{int(binary.LittleEndian.Uint16(p[7:])), int(binary.LittleEndian.Uint16(p[5:]))} {
+				if n > 0 {
+					r.defs = append(r.defs, n)
+				}
+			}
+			if len(r.defs) == 0 {
+				return true
+			}
+			r.phase = MySQLPhaseDefs
+			return false
+		case p[0] == MySQLOK || (p[0] == MySQLEOF && size < 9):
+			return mysqlStatus(p)&MySQLServerMoreResults == 0
+		case r.cmd == MySQLFieldList:
+			r.phase = MySQLPhaseFields
+			return false
+		case r.cmd == MySQLStatistics || p[0] == 0xFB:
+			return true
+		}
+
+		// Result set: column count, column definitions, rows and the terminator
+		cols, _ := mysqlLenenc(p)
+		if cols == 0 {
+			return true
+		}
+		r.defs = append(r.defs, int(cols))
+		r.phase = MySQLPhaseDefs
+		return false
+
+	case MySQLPhaseDefs:
+		if r.defs[0]--; r.defs[0] > 0 {
+			return false
+		}
+		r.defs = r.defs[1:]
+		switch {
+		case c.caps&MySQLClientDeprecateEOF != 0:
+			return c.after(r)
+		case c.caps == 0 && r.cmd == MySQLStmtPrepare && len(r.defs) == 0:
+			c.trailer = true
+			return true
+		}
+		r.phase = MySQLPhaseEOF
+		return false
+
+	case MySQLPhaseEOF:
+		// EOF has exactly 5 bytes, an OK packet replacing EOF is longer
+		if size == 5 && p[0] == MySQLEOF {
+			return mysqlStatus(p)&MySQLServerCursorExists != 0 || c.after(r)
+		}
+		if c.after(r) {
+			return true
+		}
+		return c.next(r, p, size)
+
+	case MySQLPhaseRows:
+		switch {
+		case p[0] == MySQLError:
+			r.err = append([]byte(nil), p...)
+			return true
+		case p[0] == MySQLEOF && size < MySQLMaxPacket:
+			if mysqlStatus(p)&MySQLServerMoreResults == 0 {
+				return true
+			}
+			r.phase = MySQLPhaseResult
+			return false
+		}
+		r.rows++
+		return false
+
+	case MySQLPhaseFields:
+		switch p[0] {
+		case MySQLError:
+			r.err = append([]byte(nil), p...)
+			return true
+		case MySQLEOF:
+			return true
+		}
+	}
+
+	return false
+}
+
+// after move to the phase after the block of definitions, return whether the response ends
+func (c *MySQLConn) after(r *MySQLResult) bool {
+	switch {
+	case len(r.defs) > 0:
+		r.phase = MySQLPhaseDefs
+	case r.cmd == MySQLStmtPrepare:
+		return true
+	default:
+		r.phase = MySQLPhaseRows
+	}
+
+	return false
+}
 
 // Run parse packets
 func (m *MySQLParser) Run(v *Packet) {
-	var pos int
-	p := []byte(v.Payload)
-	if len(p) < 5 {
-		return
+	c := m.conn(v)
+	data := []byte(v.Payload)
+
+	var kind byte = MySQLUnknown
+	if v.Request && len(c.reqs) > 0 {
+		kind, c.reqs = c.reqs[0], c.reqs[1:]
+	}
+	r := &MySQLResult{cmd: MySQLUnknown}
+	if !v.Request && len(c.rsps) > 0 {
+		r, c.rsps = c.rsps[0], c.rsps[1:]
 	}
 
-	// TODO: Why truncated the first 7 bytes?
-	plen := int(uint32(p[0]) | uint32(p[1])<<8 | uint32(p[2])<<16)
-	sid := p[3]
-	if sid != 0 || len(p) < plen+4 {
+	// The payload is only the head of a long message
+	payload, end := mysqlPeek(data, 0)
+	if c.tls || end == 0 || len(payload) == 0 || r.cmd == MySQLTrailer {
+		v.Ignore = true
 		return
 	}
 
-	// Request
-	pos = 4
 	if v.Request {
-		switch p[pos] {
-		case MySQLQuit, MySQLInitDB, MySQLQuery, MySQLFieldList, MySQLCreateDB,
-			MySQLDropDB, MySQLRefresh, MySQLShutdown, MySQLStatistics,
-			MySQLProcessInfo, MySQLProcessKill, MySQLPing, MySQLChangeUser,
-			MySQLStmtPrepare:
-			v.Content = string(p[pos+1:])
-		case MySQLStmtSendLongData:
-			// TODO: parse payload
-			v.Content = ""
-		case MySQLStmtReset:
-			// TODO: parse payload
-			v.Content = ""
-		case MySQLStmtExecute:
-			// TODO: parse payload
-			v.Content = ""
-		default:
-			v.Content = ""
+		m.request(c, v, kind, payload)
+	} else {
+		m.response(c, v, r, payload)
+	}
+	v.User, v.Database = c.user, c.schema
+}
+
+// request decode the client request
+func (m *MySQLParser) request(c *MySQLConn, v *Packet, kind byte, p []byte) {
+	switch kind {
+	case MySQLAuth:
+		v.Ignore = true
+		return
+	case MySQLLogin:
+		c.handshake(p)
+		v.Command = MySQLCommands[MySQLLogin]
+		v.Content = fmt.Sprintf("%s@%s", c.user, c.schema)
+		return
+	}
+
+	cmd := p[0]
+	body := p[1:]
+	v.Command = MySQLCommands[cmd]
+	switch cmd {
+	case MySQLQuery, MySQLStmtPrepare:
+		v.Content = string(body)
+		if cmd == MySQLQuery {
+			v.Command = sqlVerb(v.Content, v.Command)
+		} else {
+			c.prepares = append(c.prepares, v.Content)
+		}
+	case MySQLInitDB:
+		c.schema = string(body)
+		v.Content = c.schema
+	case MySQLFieldList, MySQLCreateDB, MySQLDropDB:
+		v.Content = strings.TrimRight(string(body), "\x00")
+	case MySQLChangeUser:
+		if i := strings.IndexByte(string(body), 0); i >= 0 {
+			c.user = string(body[:i])
+		}
+		v.Content = c.user
+	case MySQLProcessKill:
+		if len(body) >= 4 {
+			v.Content = fmt.Sprintf("%d", binary.LittleEndian.Uint32(body))
+		}
+	case MySQLQuit, MySQLBinglogDump:
+		v.Ignore = true
+	case MySQLStmtExecute:
+		v.Content = c.execute(body)
+		if len(body) >= 4 {
+			if stmt := c.stmts[binary.LittleEndian.Uint32(body)]; stmt != nil {
+				v.Command = sqlVerb(stmt.query, v.Command)
+			}
+		}
+	case MySQLStmtSendLongData:
+		// No response for the long data
+		v.Ignore = true
+		if len(body) < 6 {
+			return
+		}
+		if stmt := c.stmts[binary.LittleEndian.Uint32(body)]; stmt != nil {
+			id := int(binary.LittleEndian.Uint16(body[4:]))
+			stmt.long[id] = append(stmt.long[id], body[6:]...)
+		}
+	case MySQLStmtClose, MySQLStmtReset, MySQLStmtFetch:
+		if len(body) < 4 {
+			return
 		}
+		id := binary.LittleEndian.Uint32(body)
+		v.Content = fmt.Sprintf("stmt %d", id)
+		if stmt := c.stmts[id]; stmt != nil {
+			v.Content = stmt.query
+			if cmd == MySQLStmtReset {
+				stmt.long = make(map[int][]byte)
+			}
+		}
+		if cmd == MySQLStmtClose {
+			delete(c.stmts, id)
+			v.Ignore = true
+		}
+	}
+}
 
+// handshake decode the handshake response
+func (c *MySQLConn) handshake(p []byte) {
+	if len(p) < 32 {
 		return
 	}
 
-	// Response
-	pos = 0
-	switch p[pos] {
-	case MySQLOK:
-		v.Content = "ok"
-	case MySQLError:
-		v.Content = "error"
-	case MySQLEOF:
-		v.Content = ""
+	caps := binary.LittleEndian.Uint32(p)
+	if c.caps != 0 {
+		caps &= c.caps
+	}
+	c.caps = caps
+
+	user, pos := cstring(p, 32)
+	c.user = user
+	if pos >= len(p) {
+		return
+	}
+
+	// Skip the auth response
+	switch {
+	case caps&MySQLClientAuthLenencData != 0:
+		n, size := mysqlLenenc(p[pos:])
+		if n > uint64(len(p)-pos-size) {
+			return
+		}
+		pos += size + int(n)
+	case caps&MySQLClientSecureConn != 0:
+		pos += 1 + int(p[pos])
+	default:
+		_, pos = cstring(p, pos)
+	}
+
+	if caps&MySQLClientConnectWithDB != 0 && pos < len(p) {
+		c.schema, _ = cstring(p, pos)
+	}
+}
+
+// execute decode COM_STMT_EXECUTE into the sql with bound parameters
+func (c *MySQLConn) execute(p []byte) string {
+	if len(p) < 9 {
+		return ""
+	}
+
+	id := binary.LittleEndian.Uint32(p)
+	stmt := c.stmts[id]
+	if stmt == nil {
+		return fmt.Sprintf("stmt %d", id)
+	}
+	if stmt.params == 0 {
+		return stmt.query
+	}
+
+	// Null bitmap, new-params-bound flag, parameter types and values
+	pos := 9
+	nulls := p[pos:]
+	pos += (stmt.params + 7) / 8
+	if pos >= len(p) {
+		return stmt.query
+	}
+	if p[pos] == 1 {
+		pos++
+		if len(p) < pos+stmt.params*2 {
+			return stmt.query
+		}
+		stmt.types = make([]uint16, stmt.params)
+		for i := range stmt.types {
+			stmt.types[i] = binary.LittleEndian.Uint16(p[pos+i*2:])
+		}
+		pos += stmt.params * 2
+	} else {
+		pos++
+	}
+
+	args := make([]string, stmt.params)
+	for i := range args {
+		if nulls[i/8]&(1<<uint(i%8)) != 0 {
+			args[i] = "NULL"
+			continue
+		}
+		if data, ok := stmt.long[i]; ok {
+			args[i] = mysqlQuote(data)
+			continue
+		}
+		if i >= len(stmt.types) || pos > len(p) {
+			args[i] = "?"
+			continue
+		}
+		arg, n := mysqlValue(p[pos:], stmt.types[i])
+		if n < 0 {
+			args[i] = "?"
+			pos = len(p) + 1
+			continue
+		}
+		args[i] = arg
+		pos += n
+	}
+	stmt.long = make(map[int][]byte)
+
+	return mysqlBind(stmt.query, args)
+}
+
+// response decode the server response
+func (m *MySQLParser) response(c *MySQLConn, v *Packet, r *MySQLResult, p []byte) {
+	switch r.cmd {
+	case MySQLAuth:
+		// Keep the capabilities of server from the initial handshake
+		if p[0] == 0x0A {
+			c.caps = mysqlServerCaps(p)
+		}
+		v.Ignore = true
+		return
+	case MySQLStmtPrepare:
+		query := ""
+		if len(c.prepares) > 0 {
+			query, c.prepares = c.prepares[0], c.prepares[1:]
+		}
+		if p[0] == MySQLOK && len(p) >= 9 {
+			id := binary.LittleEndian.Uint32(p[1:])
+			cols := int(binary.LittleEndian.Uint16(p[5:]))
+			params := int(binary.LittleEndian.Uint16(p[7:]))
+			c.stmts[id] = &MySQLStmt{query: query, params: params, long: make(map[int][]byte)}
+			v.Status = "ok"
+			v.Content = fmt.Sprintf("stmt %d, %d params, %d columns", id, params, cols)
+			return
+		}
+	}
+
+	switch {
+	case r.err != nil:
+		mysqlError(v, r.err)
+	case r.cmd != MySQLStmtFetch && (p[0] == MySQLOK || (p[0] == MySQLEOF && len(p) < 9)):
+		affected, insert := mysqlOK(p)
+		v.Status = "ok"
+		v.Rows = int64(affected)
+		v.Content = fmt.Sprintf("OK, %d rows affected", affected)
+		if insert != 0 {
+			v.Content += fmt.Sprintf(", last insert id %d", insert)
+		}
+	case r.cmd == MySQLStatistics:
+		v.Status = "ok"
+		v.Content = string(p)
+	default:
+		v.Status = "ok"
+		v.Rows = r.rows
+		v.Content = fmt.Sprintf("%d rows in set", r.rows)
+	}
+}
+
+// mysqlSide index of the direction of v, 0 for request and 1 for response
+func mysqlSide(v *Packet) int {
+	if v.Request {
+		return 0
+	}
+
+	return 1
+}
+
+// mysqlPeek return the payload of the packet at pos, which is cut at the end of data,
+// and the position after the packet, the position is 0 if the head of the packet is incomplete
+func mysqlPeek(data []byte, pos int) ([]byte, int) {
+	if len(data) < pos+4 {
+		return nil, 0
+	}
+	plen := int(uint32(data[pos]) | uint32(data[pos+1])<<8 | uint32(data[pos+2])<<16)
+	end := pos + 4 + plen
+	if len(data) < pos+4+plen && len(data) < pos+4+MySQLPeekSize {
+		return nil, 0
+	}
+	if end > len(data) {
+		return data[pos+4:], end
+	}
+
+	return data[pos+4 : end], end
+}
+
+// mysqlLenenc decode the length encoded integer, return the value and its size
+func mysqlLenenc(p []byte) (uint64, int) {
+	if len(p) == 0 {
+		return 0, 0
+	}
+
+	switch p[0] {
+	case 0xFB:
+		return 0, 1
+	case 0xFC:
+		if len(p) >= 3 {
+			return uint64(binary.LittleEndian.Uint16(p[1:])), 3
+		}
+	case 0xFD:
+		if len(p) >= 4 {
+			return uint64(p[1]) | uint64(p[2])<<8 | uint64(p[3])<<16, 4
+		}
+	case 0xFE:
+		if len(p) >= 9 {
+			return binary.LittleEndian.Uint64(p[1:]), 9
+		}
 	default:
-		v.Content = "not find case"
+		return uint64(p[0]), 1
 	}
+
+	return 0, len(p)
+}
+
+// mysqlServerCaps capability flags in the initial handshake
+func mysqlServerCaps(p []byte) uint32 {
+	_, pos := cstring(p, 1)
+	// Connection id, auth data part 1 and filler
+	pos += 4 + 8 + 1
+	if len(p) < pos+2 {
+		return 0
+	}
+	caps := uint32(binary.LittleEndian.Uint16(p[pos:]))
+	// Character set and status flags
+	pos += 2 + 1 + 2
+	if len(p) >= pos+2 {
+		caps |= uint32(binary.LittleEndian.Uint16(p[pos:])) << 16
+	}
+
+	return caps
+}
+
+// mysqlOK decode the affected rows and last insert id of OK packet
+func mysqlOK(p []byte) (uint64, uint64) {
+	affected, n := mysqlLenenc(p[1:])
+	insert, _ := mysqlLenenc(p[1+n:])
+	return affected, insert
+}
+
+// mysqlStatus status flags of OK or EOF packet
+func mysqlStatus(p []byte) uint16 {
+	if p[0] == MySQLEOF && len(p) == 5 {
+		return binary.LittleEndian.Uint16(p[3:])
+	}
+
+	pos := 1
+	_, n := mysqlLenenc(p[pos:])
+	pos += n
+	_, n = mysqlLenenc(p[pos:])
+	pos += n
+	if len(p) < pos+2 {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint16(p[pos:])
+}
+
+// mysqlError decode ERR packet into code, sql state and message
+func mysqlError(v *Packet, p []byte) {
+	v.Error = true
+	v.Status = "error"
+	if len(p) < 3 {
+		v.Content = "error"
+		return
+	}
+
+	code := binary.LittleEndian.Uint16(p[1:])
+	msg := string(p[3:])
+	state := ""
+	if len(p) >= 9 && p[3] == '#' {
+		state, msg = string(p[4:9]), string(p[9:])
+	}
+	v.Status = fmt.Sprintf("%d", code)
+	v.Content = fmt.Sprintf("ERROR %d (%s): %s", code, state, msg)
+}
+
+// mysqlValue decode the parameter of binary protocol, return its text and size
+func mysqlValue(p []byte, typ uint16) (string, int) {
+	unsigned := typ&MySQLTypeUnsigned != 0
+	need := func(n int) bool { return len(p) >= n }
+
+	switch typ &^ MySQLTypeUnsigned {
+	case MySQLTypeNull:
+		return "NULL", 0
+	case MySQLTypeTiny:
+		if !need(1) {
+			return "", -1
+		}
+		if unsigned {
+			return fmt.Sprintf("%d", p[0]), 1
+		}
+		return fmt.Sprintf("%d", int8(p[0])), 1
+	case MySQLTypeShort, MySQLTypeYear:
+		if !need(2) {
+			return "", -1
+		}
+		n := binary.LittleEndian.Uint16(p)
+		if unsigned {
+			return fmt.Sprintf("%d", n), 2
+		}
+		return fmt.Sprintf("%d", int16(n)), 2
+	case MySQLTypeLong, MySQLTypeInt24:
+		if !need(4) {
+			return "", -1
+		}
+		n := binary.LittleEndian.Uint32(p)
+		if unsigned {
+			return fmt.Sprintf("%d", n), 4
+		}
+		return fmt.Sprintf("%d", int32(n)), 4
+	case MySQLTypeLongLong:
+		if !need(8) {
+			return "", -1
+		}
+		n := binary.LittleEndian.Uint64(p)
+		if unsigned {
+			return fmt.Sprintf("%d", n), 8
+		}
+		return fmt.Sprintf("%d", int64(n)), 8
+	case MySQLTypeFloat:
+		if !need(4) {
+			return "", -1
+		}
+		return fmt.Sprintf("%v", math.Float32frombits(binary.LittleEndian.Uint32(p))), 4
+	case MySQLTypeDouble:
+		if !need(8) {
+			return "", -1
+		}
+		return fmt.Sprintf("%v", math.Float64frombits(binary.LittleEndian.Uint64(p))), 8
+	case MySQLTypeDate, MySQLTypeDatetime, MySQLTypeTimestamp:
+		if !need(1) || !need(1+int(p[0])) {
+			return "", -1
+		}
+		n, d := int(p[0]), p[1:]
+		v := "0000-00-00"
+		if n >= 4 {
+			v = fmt.Sprintf("%04d-%02d-%02d", binary.LittleEndian.Uint16(d), d[2], d[3])
+		}
+		if n >= 7 {
+			v += fmt.Sprintf(" %02d:%02d:%02d", d[4], d[5], d[6])
+		}
+		if n >= 11 {
+			v += fmt.Sprintf(".%06d", binary.LittleEndian.Uint32(d[7:]))
+		}
+		return "'" + v + "'", 1 + n
+	case MySQLTypeTime:
+		if !need(1) || !need(1+int(p[0])) {
+			return "", -1
+		}
+		n, d := int(p[0]), p[1:]
+		v := "00:00:00"
+		if n >= 8 {
+			hours := binary.LittleEndian.Uint32(d[1:])*24 + uint32(d[5])
+			v = fmt.Sprintf("%02d:%02d:%02d", hours, d[6], d[7])
+			if d[0] == 1 {
+				v = "-" + v
+			}
+		}
+		if n >= 12 {
+			v += fmt.Sprintf(".%06d", binary.LittleEndian.Uint32(d[8:]))
+		}
+		return "'" + v + "'", 1 + n
+	}
+
+	// Strings, decimals, blobs and the other length encoded types
+	n, size := mysqlLenenc(p)
+	if size == 0 || uint64(len(p)-size) < n {
+		return "", -1
+	}
+
+	return mysqlQuote(p[size : size+int(n)]), size + int(n)
+}
+
+// mysqlQuote quote the string parameter
+func mysqlQuote(p []byte) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(string(p)) + "'"
+}
+
+// mysqlBind replace the placeholders outside quotes with parameters
+func mysqlBind(query string, args []string) string {
+	var b strings.Builder
+	var quote rune
+	i := 0
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '?' && i < len(args):
+			b.WriteString(args[i])
+			i++
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
 }
@@ -1,15 +1,22 @@
 package parser
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 // Parse parse packets
 const (
 	RAW       = "raw"
 	DNS       = "dns"
 	HTTP      = "http"
+	HTTP2     = "http2"
+	GRPC      = "grpc"
 	Redis     = "redis"
 	Memcached = "memcached"
 	MySQL     = "mysql"
+	Postgres  = "postgres"
+	MongoDB   = "mongodb"
 )
 
 // DefaultParser default protocol type
@@ -18,6 +25,7 @@ const DefaultParser = Redis
 // Packet packet
 type Packet struct {
 	Type       string
+	Transport  string
 	Request    bool
 	Direction  string
 	SrcID      string
@@ -36,8 +44,16 @@ type Packet struct {
 	Payload    string
 	PayloadLen int
 	Content    string
+	Command    string
+	Status     string
+	Error      bool
+	User       string
+	Database   string
+	Rows       int64
+	MatchID    string
 	Timestap   time.Time
 	Ignore     bool
+	Implied    []*Packet // Replies of the earlier requests implied by this reply
 }
 
 // Parser interface
@@ -45,6 +61,56 @@ type Parser interface {
 	Run(v *Packet)
 }
 
+// Splitter split the reassembled stream into messages
+type Splitter interface {
+	// Split return the length of the first part of message in data and whether the
+	// message continues after it, the length may exceed data once it is told by the
+	// header, 0 if more data is needed, or -1 if the data can not be framed
+	Split(v *Packet, data []byte) (int, bool)
+}
+
+// Closer release the state kept for a closed connection
+type Closer interface {
+	Close(v *Packet)
+}
+
+// Resetter drop the framing state of the direction of v once its stream lost the
+// framing, the messages in flight of the direction are gone
+type Resetter interface {
+	Reset(v *Packet)
+}
+
+// ConnID id of the connection in "client -> server" direction
+func ConnID(v *Packet) string {
+	if v.Request {
+		return v.SrcID + " -> " + v.DstID
+	}
+
+	return v.DstID + " -> " + v.SrcID
+}
+
+// cstring decode the null terminated string at pos, return it and the position after it
+func cstring(p []byte, pos int) (string, int) {
+	if pos < 0 || pos >= len(p) {
+		return "", len(p)
+	}
+	i := strings.IndexByte(string(p[pos:]), 0)
+	if i < 0 {
+		return string(p[pos:]), len(p)
+	}
+
+	return string(p[pos : pos+i]), pos + i + 1
+}
+
+// sqlVerb verb of the sql, or def if sql is empty
+func sqlVerb(sql, def string) string {
+	if fields := strings.Fields(sql); len(fields) > 0 {
+		return strings.ToUpper(fields[0])
+	}
+
+	return def
+}
+
 // NewParser new parser
 func NewParser(v string) Parser {
 	switch v {
@@ -54,12 +120,18 @@ func NewParser(v string) Parser {
 		return &DNSParser{}
 	case HTTP:
 		return &HTTPParser{}
+	case HTTP2, GRPC:
+		return &HTTP2Parser{}
 	case Redis:
 		return &RedisParser{}
 	case Memcached:
 		return &MemcachedParser{}
 	case MySQL:
 		return &MySQLParser{}
+	case Postgres:
+		return &PostgresParser{}
+	case MongoDB:
+		return &MongoDBParser{}
 	}
 
 	return nil
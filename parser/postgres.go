@@ -0,0 +1,581 @@
+package parser
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* PostgreSQL frontend/backend protocol message format
+
+https://www.postgresql.org/docs/current/protocol-message-formats.html
+
++---------------+---------------+------------------------------------+
+|    1 Byte     |    4 Bytes    |              N Bytes               |
++---------------+---------------+------------------------------------+
+|     type      |    length     |        body of the message         |
+|               | (with itself) |                                    |
++---------------+---------------+------------------------------------+
+
+The startup, ssl, gssenc and cancel requests have no type byte.
+*/
+
+// Postgres codes of the messages without type byte
+const (
+	PostgresProtocol3   = 196608   // 3.0
+	PostgresCancel      = 80877102 // CancelRequest
+	PostgresSSL         = 80877103 // SSLRequest
+	PostgresGSSEnc      = 80877104 // GSSENCRequest
+	PostgresStartup     = "STARTUP"
+	PostgresMaxMessage  = 64 << 20
+	PostgresMinStartup  = 8
+	PostgresHeaderLen   = 5
+	PostgresAuthOK      = 0
+	PostgresAuthSASLEnd = 12
+)
+
+// Postgres frontend message types
+const (
+	PostgresQuery        = 'Q'
+	PostgresParse        = 'P'
+	PostgresBind         = 'B'
+	PostgresDescribe     = 'D'
+	PostgresExecute      = 'E'
+	PostgresSync         = 'S'
+	PostgresFlush        = 'H'
+	PostgresClose        = 'C'
+	PostgresTerminate    = 'X'
+	PostgresPassword     = 'p'
+	PostgresFunctionCall = 'F'
+	PostgresCopyData     = 'd'
+	PostgresCopyDone     = 'c'
+	PostgresCopyFail     = 'f'
+)
+
+// Postgres backend message types
+const (
+	PostgresAuthentication  = 'R'
+	PostgresCommandComplete = 'C'
+	PostgresDataRow         = 'D'
+	PostgresEmptyQuery      = 'I'
+	PostgresErrorResponse   = 'E'
+	PostgresCopyInResponse  = 'G'
+	PostgresCopyBothRsp     = 'W'
+	PostgresNotification    = 'A'
+	PostgresReadyForQuery   = 'Z'
+)
+
+// PostgresCommands names of the frontend messages reported as commands
+var PostgresCommands = map[byte]string{
+	PostgresQuery:        "QUERY",
+	PostgresParse:        "PARSE",
+	PostgresBind:         "BIND",
+	PostgresDescribe:     "DESCRIBE",
+	PostgresExecute:      "EXECUTE",
+	PostgresSync:         "SYNC",
+	PostgresFlush:        "FLUSH",
+	PostgresClose:        "CLOSE",
+	PostgresFunctionCall: "FUNCTION_CALL",
+	PostgresCopyData:     "COPY_DATA",
+	PostgresCopyDone:     "COPY_DONE",
+	PostgresCopyFail:     "COPY_FAIL",
+}
+
+// PostgresRowTags tags of CommandComplete ending with the number of rows
+var PostgresRowTags = map[string]bool{
+	"SELECT": true, "INSERT": true, "UPDATE": true, "DELETE": true,
+	"FETCH": true, "MOVE": true, "COPY": true, "MERGE": true,
+}
+
+// PostgresConn state of a postgres connection
+type PostgresConn struct {
+	user    string                     // User from the startup message
+	db      string                     // Database from the startup message
+	auth    bool                       // In the authentication phase
+	ssl     bool                       // SSLRequest or GSSENCRequest is waiting for the answer
+	tls     bool                       // Switched to ssl or gss encryption, the payload is not readable
+	stmts   map[string]string          // Sql of the prepared statements by name
+	portals map[string]*PostgresPortal // Portals by name
+	rsp     *PostgresResult            // Response being framed
+	rsps    []*PostgresResult          // Framed responses waiting to be decoded
+}
+
+// PostgresResult summary of a response, which is framed message by message
+type PostgresResult struct {
+	tags     []string // Tags of CommandComplete
+	rows     int64    // Rows in the tags
+	datarows int64    // DataRow messages
+	err      []byte   // Body of the last ErrorResponse
+	ignore   bool     // Whether the response answers no request
+}
+
+// PostgresPortal portal created by Bind
+type PostgresPortal struct {
+	stmt  string // Name of the prepared statement
+	query string // Sql with the bound parameters
+}
+
+// PostgresParser postgres parser, the requests are the simple queries or the extended
+// queries until Sync, and the responses last until ReadyForQuery
+type PostgresParser struct {
+	conns map[string]*PostgresConn // Connections by "client -> server"
+}
+
+// conn find or create the state of connection
+func (m *PostgresParser) conn(v *Packet) *PostgresConn {
+	if m.conns == nil {
+		m.conns = make(map[string]*PostgresConn)
+	}
+
+	id := ConnID(v)
+	c, ok := m.conns[id]
+	if !ok {
+		c = &PostgresConn{stmts: make(map[string]string), portals: make(map[string]*PostgresPortal)}
+		m.conns[id] = c
+	}
+
+	return c
+}
+
+// Close release the state of connection
+func (m *PostgresParser) Close(v *Packet) {
+	delete(m.conns, ConnID(v))
+}
+
+// Reset drop the response being framed
+func (m *PostgresParser) Reset(v *Packet) {
+	if !v.Request {
+		m.conn(v).rsp = nil
+	}
+}
+
+// Split split the stream into typed messages, the messages of a request or response are
+// the parts of it
+func (m *PostgresParser) Split(v *Packet, data []byte) (int, bool) {
+	c := m.conn(v)
+	if c.tls {
+		return len(data), false
+	}
+
+	if v.Request {
+		// The messages without type byte start with the high byte of length
+		if data[0] == 0 {
+			if len(data) < PostgresMinStartup {
+				return 0, false
+			}
+			size := int(binary.BigEndian.Uint32(data))
+			if size < PostgresMinStartup || size > PostgresMaxMessage {
+				return -1, false
+			}
+			if len(data) < size {
+				return 0, false
+			}
+			switch binary.BigEndian.Uint32(data[4:]) {
+			case PostgresSSL, PostgresGSSEnc:
+				c.ssl = true
+			case PostgresProtocol3:
+				c.auth = true
+			}
+			return size, false
+		}
+
+		typ, n := postgresMessage(data)
+		if n <= 0 {
+			return n, false
+		}
+		switch typ {
+		case PostgresParse, PostgresBind, PostgresDescribe, PostgresExecute, PostgresClose,
+			PostgresFlush, PostgresCopyData:
+			return n, true
+		}
+		return n, false
+	}
+
+	// The answer of SSLRequest or GSSENCRequest is a single byte
+	if c.ssl {
+		c.ssl = false
+		switch data[0] {
+		case 'S', 'G':
+			c.tls = true
+			return 1, false
+		case 'N':
+			return 1, false
+		}
+	}
+
+	typ, n := postgresMessage(data)
+	if n <= 0 {
+		return n, false
+	}
+	// The messages decoded while framing are complete, while the rows are not needed
+	switch typ {
+	case PostgresAuthentication, PostgresCommandComplete, PostgresErrorResponse:
+		if len(data) < n {
+			return 0, false
+		}
+	}
+	body := data[PostgresHeaderLen:]
+	if len(body) > n-PostgresHeaderLen {
+		body = body[:n-PostgresHeaderLen]
+	}
+
+	// The notifications are sent at any time
+	if typ == PostgresNotification && c.rsp == nil {
+		c.rsps = append(c.rsps, &PostgresResult{ignore: true})
+		return n, false
+	}
+
+	if c.rsp == nil {
+		c.rsp = &PostgresResult{}
+	}
+	if !c.rsp.add(c, typ, body) {
+		return n, true
+	}
+	c.rsps = append(c.rsps, c.rsp)
+	c.rsp = nil
+
+	return n, false
+}
+
+// add track the backend message in the result, return whether the response ends
+func (r *PostgresResult) add(c *PostgresConn, typ byte, body []byte) bool {
+	switch typ {
+	case PostgresReadyForQuery:
+		c.auth = false
+		return true
+	case PostgresCopyInResponse:
+		r.tags = append(r.tags, "COPY IN")
+		return true
+	case PostgresCopyBothRsp:
+		return true
+	case PostgresAuthentication:
+		// The challenges are answered by the client before the authentication goes on,
+		// and they are not responses of requests
+		r.ignore = postgresChallenge(body)
+		return r.ignore
+	case PostgresErrorResponse:
+		r.err = append(r.err[:0], body...)
+		// The server closes the connection after the errors of authentication
+		return c.auth
+	case PostgresCommandComplete:
+		tag, _ := cstring(body, 0)
+		r.tags = append(r.tags, tag)
+		if fields := strings.Fields(tag); len(fields) > 1 && PostgresRowTags[fields[0]] {
+			n, _ := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+			r.rows += n
+		}
+	case PostgresDataRow:
+		r.datarows++
+	case PostgresEmptyQuery:
+		r.tags = append(r.tags, "EMPTY")
+	}
+
+	return false
+}
+
+// Run parse packets
+func (m *PostgresParser) Run(v *Packet) {
+	c := m.conn(v)
+	data := []byte(v.Payload)
+	if c.tls || len(data) < PostgresHeaderLen {
+		v.Ignore = true
+		return
+	}
+
+	if v.Request {
+		m.request(c, v, data)
+	} else {
+		m.response(c, v)
+	}
+	v.User, v.Database = c.user, c.db
+}
+
+// request decode the startup message, simple query, or the extended query
+func (m *PostgresParser) request(c *PostgresConn, v *Packet, data []byte) {
+	if data[0] == 0 {
+		if len(data) < PostgresMinStartup || binary.BigEndian.Uint32(data[4:]) != PostgresProtocol3 {
+			v.Ignore = true
+			return
+		}
+		c.startup(data[PostgresMinStartup:])
+		v.Command = PostgresStartup
+		v.Content = fmt.Sprintf("%s@%s", c.user, c.db)
+		return
+	}
+
+	var cmds, parses, executes []string
+	postgresWalk(data, func(typ byte, body []byte) bool {
+		switch typ {
+		case PostgresQuery:
+			query, _ := cstring(body, 0)
+			cmds = append(cmds, sqlVerb(query, PostgresCommands[typ]))
+			executes = append(executes, query)
+		case PostgresParse:
+			name, pos := cstring(body, 0)
+			query, _ := cstring(body, pos)
+			c.stmts[name] = query
+			parses = append(parses, postgresNamed(query, name, ""))
+		case PostgresBind:
+			c.bind(body)
+		case PostgresExecute:
+			name, _ := cstring(body, 0)
+			portal := c.portals[name]
+			if portal == nil {
+				portal = &PostgresPortal{}
+			}
+			cmds = append(cmds, sqlVerb(portal.query, PostgresCommands[typ]))
+			executes = append(executes, postgresNamed(portal.query, portal.stmt, name))
+		case PostgresClose:
+			if len(body) > 0 {
+				name, _ := cstring(body, 1)
+				if body[0] == 'S' {
+					delete(c.stmts, name)
+				} else {
+					delete(c.portals, name)
+				}
+			}
+		case PostgresCopyData:
+			executes = append(executes, fmt.Sprintf("%d bytes", len(body)))
+		case PostgresTerminate, PostgresPassword:
+			// No response for terminate, and the authentication is reported by startup
+			v.Ignore = true
+		}
+		return false
+	})
+	if v.Ignore {
+		return
+	}
+
+	// The executions are reported rather than the preparations of them
+	v.Command = PostgresCommands[data[0]]
+	v.Content = strings.Join(parses, "; ")
+	if len(cmds) > 0 {
+		v.Command = cmds[0]
+	}
+	if len(executes) > 0 {
+		v.Content = strings.Join(executes, "; ")
+	}
+}
+
+// response report the command complete tags, rows and errors of the framed response
+func (m *PostgresParser) response(c *PostgresConn, v *Packet) {
+	if len(c.rsps) == 0 {
+		v.Ignore = true
+		return
+	}
+	r := c.rsps[0]
+	c.rsps = c.rsps[1:]
+	if r.ignore {
+		v.Ignore = true
+		return
+	}
+
+	v.Status = "ok"
+	if r.err != nil {
+		postgresError(v, r.err)
+		return
+	}
+
+	v.Rows = r.rows
+	if v.Rows == 0 {
+		v.Rows = r.datarows
+	}
+	v.Content = strings.Join(r.tags, "; ")
+	if v.Content == "" {
+		v.Content = "OK"
+	}
+}
+
+// startup decode the parameters of startup message
+func (c *PostgresConn) startup(p []byte) {
+	c.user, c.db = "", ""
+	for pos := 0; pos < len(p) && p[pos] != 0; {
+		var k, val string
+		k, pos = cstring(p, pos)
+		val, pos = cstring(p, pos)
+		switch k {
+		case "user":
+			c.user = val
+		case "database":
+			c.db = val
+		}
+	}
+	if c.db == "" {
+		c.db = c.user
+	}
+}
+
+// bind decode Bind into the portal with the sql and its parameters
+func (c *PostgresConn) bind(p []byte) {
+	name, pos := cstring(p, 0)
+	stmt, pos := cstring(p, pos)
+	portal := &PostgresPortal{stmt: stmt, query: c.stmts[stmt]}
+	c.portals[name] = portal
+	if pos+2 > len(p) {
+		return
+	}
+
+	// Formats of the parameters, none for text, one for all, or one for each
+	n := int(binary.BigEndian.Uint16(p[pos:]))
+	pos += 2
+	if pos+n*2+2 > len(p) {
+		return
+	}
+	formats := make([]uint16, n)
+	for i := range formats {
+		formats[i] = binary.BigEndian.Uint16(p[pos+i*2:])
+	}
+	pos += n * 2
+
+	args := make([]string, binary.BigEndian.Uint16(p[pos:]))
+	pos += 2
+	for i := range args {
+		if pos+4 > len(p) {
+			return
+		}
+		size := int(int32(binary.BigEndian.Uint32(p[pos:])))
+		pos += 4
+		if size < 0 {
+			args[i] = "NULL"
+			continue
+		}
+		if pos+size > len(p) {
+			return
+		}
+
+		format := uint16(0)
+		switch {
+		case len(formats) == 1:
+			format = formats[0]
+		case i < len(formats):
+			format = formats[i]
+		}
+		if format == 0 {
+			args[i] = "'" + strings.ReplaceAll(string(p[pos:pos+size]), "'", "''") + "'"
+		} else {
+			args[i] = "'\\x" + hex.EncodeToString(p[pos:pos+size]) + "'"
+		}
+		pos += size
+	}
+	portal.query = postgresBind(portal.query, args)
+}
+
+// postgresMessage return the type and length of the typed message at the start of data,
+// the length is 0 if the header is incomplete or -1 if the data is illegal
+func postgresMessage(data []byte) (byte, int) {
+	if len(data) < PostgresHeaderLen {
+		return 0, 0
+	}
+	size := int(binary.BigEndian.Uint32(data[1:]))
+	if size < 4 || size > PostgresMaxMessage {
+		return 0, -1
+	}
+
+	return data[0], 1 + size
+}
+
+// postgresWalk walk the typed messages in data until the one ending the request or
+// response, return the length of them, 0 if incomplete or -1 if the data is illegal
+func postgresWalk(data []byte, end func(typ byte, body []byte) bool) int {
+	pos := 0
+	for {
+		if len(data)-pos < PostgresHeaderLen {
+			return 0
+		}
+		size := int(binary.BigEndian.Uint32(data[pos+1:]))
+		if size < 4 || size > PostgresMaxMessage {
+			return -1
+		}
+		if len(data)-pos < 1+size {
+			return 0
+		}
+		typ, body := data[pos], data[pos+PostgresHeaderLen:pos+1+size]
+		pos += 1 + size
+		if end(typ, body) {
+			return pos
+		}
+	}
+}
+
+// postgresChallenge whether the authentication message waits for the answer of client
+func postgresChallenge(body []byte) bool {
+	if len(body) < 4 {
+		return false
+	}
+	code := binary.BigEndian.Uint32(body)
+
+	return code != PostgresAuthOK && code != PostgresAuthSASLEnd
+}
+
+// postgresError decode ErrorResponse into sql state, message and detail
+func postgresError(v *Packet, p []byte) {
+	v.Error = true
+	v.Status = "error"
+	fields := make(map[byte]string)
+	for pos := 0; pos < len(p) && p[pos] != 0; {
+		var val string
+		typ := p[pos]
+		val, pos = cstring(p, pos+1)
+		fields[typ] = val
+	}
+
+	if code, ok := fields['C']; ok {
+		v.Status = code
+	}
+	severity := fields['V']
+	if severity == "" {
+		severity = fields['S']
+	}
+	v.Content = fmt.Sprintf("%s %s: %s", severity, v.Status, fields['M'])
+	if detail, ok := fields['D']; ok {
+		v.Content += fmt.Sprintf(", detail: %s", detail)
+	}
+}
+
+// postgresNamed append the names of statement and portal to the sql
+func postgresNamed(query, stmt, portal string) string {
+	var names []string
+	if stmt != "" {
+		names = append(names, fmt.Sprintf("statement %s", stmt))
+	}
+	if portal != "" {
+		names = append(names, fmt.Sprintf("portal %s", portal))
+	}
+	if len(names) == 0 {
+		return query
+	}
+
+	return fmt.Sprintf("%s (%s)", query, strings.Join(names, ", "))
+}
+
+// postgresBind replace the placeholders $n outside quotes with parameters
+func postgresBind(query string, args []string) string {
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '$':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			if n, e := strconv.Atoi(query[i+1 : j]); e == nil && n >= 1 && n <= len(args) {
+				b.WriteString(args[n-1])
+				i = j - 1
+				continue
+			}
+		}
+		b.WriteByte(ch)
+	}
+
+	return b.String()
+}
@@ -1,6 +1,9 @@
 package parser
 
 import (
+	"bytes"
+	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -13,50 +16,489 @@ const (
 	RedisArray        = '*'
 )
 
+// Redis RESP3 payload first char (https://github.com/redis/redis-specifications/blob/master/protocol/RESP3.md)
+const (
+	RedisNull      = '_'
+	RedisDouble    = ','
+	RedisBoolean   = '#'
+	RedisBulkError = '!'
+	RedisVerbatim  = '='
+	RedisBigNumber = '('
+	RedisMap       = '%'
+	RedisSet       = '~'
+	RedisAttribute = '|'
+	RedisPush      = '>'
+	RedisInline    = 0 // Inline command sent by telnet like clients
+)
+
+// RedisMaxDepth maximum nesting depth of aggregate values
+const RedisMaxDepth = 128
+
+// RedisContentSize maximum length of the rendered command or reply
+const RedisContentSize = 1024
+
+// RedisValue decoded redis value
+type RedisValue struct {
+	Type  byte
+	Text  string        // Text of the simple, number and string types
+	Null  bool          // Null value, or the -1 length of RESP2 bulk string and array
+	Elems []*RedisValue // Elements of aggregate, keys and values of map are stored alternately
+}
+
 // RedisParser redis parser
-type RedisParser struct{}
+type RedisParser struct {
+	// Elements left in the aggregates being framed by "src -> dst", -1 for the streamed ones
+	streams map[string][]int
+}
+
+// Close release the framing state of both directions
+func (r *RedisParser) Close(v *Packet) {
+	delete(r.streams, fmt.Sprintf("%s -> %s", v.SrcID, v.DstID))
+	delete(r.streams, fmt.Sprintf("%s -> %s", v.DstID, v.SrcID))
+}
+
+// Reset drop the aggregates being framed in the direction of v
+func (r *RedisParser) Reset(v *Packet) {
+	delete(r.streams, fmt.Sprintf("%s -> %s", v.SrcID, v.DstID))
+}
 
-// Run parse packets
+// Run parse packets, the payload of a long value is only its head
 func (r *RedisParser) Run(v *Packet) {
-	var cmds []string
-	p := v.Payload
+	val, n := redisParse([]byte(v.Payload), true, 0)
+	count := 0
+	if n == 0 && len(v.Payload) < v.PayloadLen {
+		val, count = redisPartial([]byte(v.Payload))
+	}
+	if val == nil {
+		v.Content = redisTruncate(strings.ReplaceAll(v.Payload, "\r\n", " "))
+		return
+	}
+
+	if v.Request {
+		r.request(v, val)
+		return
+	}
+	r.reply(v, val)
+	if count > 0 {
+		v.Rows = int64(count)
+	}
+}
+
+// request report the command and its arguments
+func (r *RedisParser) request(v *Packet, val *RedisValue) {
+	var args []string
+	switch val.Type {
+	case RedisArray:
+		for _, e := range val.Elems {
+			args = append(args, e.Text)
+		}
+	case RedisInline:
+		args = strings.Fields(val.Text)
+	}
+	if len(args) == 0 {
+		v.Ignore = true
+		return
+	}
+
+	// The acknowledgements of replica have no reply
+	v.Command = strings.ToUpper(args[0])
+	if v.Command == "REPLCONF" && len(args) > 1 && strings.ToUpper(args[1]) == "ACK" {
+		v.Ignore = true
+		return
+	}
 
-	// 忽略部分指令
-	if len(p) > 12 && strings.LastIndex(p, "REPLCONF ACK") == 0 {
+	var b strings.Builder
+	for i, arg := range args {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(redisQuote(arg))
+		if b.Len() > RedisContentSize {
+			break
+		}
+	}
+	v.Content = redisTruncate(b.String())
+}
+
+// reply classify the reply, the status of error is its prefix such as ERR, MOVED, ASK or LOADING
+func (r *RedisParser) reply(v *Packet, val *RedisValue) {
+	// Out of band data is not the reply of any request
+	if val.Type == RedisPush {
 		v.Ignore = true
 		return
 	}
 
-	// 开始解析指令
-	if len(p) > 0 {
-		switch p[0] {
-		case RedisError, RedisSimpleString, RedisInterger:
-			lines := strings.Split(p, "\r\n")
-			if len(lines) == 2 {
-				cmds = append(cmds, lines[0][1:])
-			}
-		case RedisBulkString:
-			lines := strings.Split(p, "\r\n")
-			if len(lines) == 3 {
-				cmds = append(cmds, lines[1])
-			}
-		case RedisArray:
-			lines := strings.Split(p, "\r\n")
-			for i := 2; i < len(lines); i += 2 {
-				// Parse the request commands in the pipline
-				if len(lines[i]) < 1 || len(lines[i-1]) < 1 {
-					continue
+	switch {
+	case val.Type == RedisError || val.Type == RedisBulkError:
+		v.Status, v.Error = "ERR", true
+		if fields := strings.Fields(val.Text); len(fields) > 0 {
+			v.Status = fields[0]
+		}
+	case val.Null:
+		v.Status = "nil"
+	default:
+		v.Status = "ok"
+	}
+
+	switch val.Type {
+	case RedisArray, RedisSet:
+		v.Rows = int64(len(val.Elems))
+	case RedisMap:
+		v.Rows = int64(len(val.Elems) / 2)
+	}
+
+	var b strings.Builder
+	redisText(&b, val)
+	v.Content = redisTruncate(b.String())
+}
+
+// Split split the stream by the length of redis values, the elements of aggregate
+// are the parts of it
+func (r *RedisParser) Split(v *Packet, data []byte) (int, bool) {
+	if r.streams == nil {
+		r.streams = make(map[string][]int)
+	}
+	id := fmt.Sprintf("%s -> %s", v.SrcID, v.DstID)
+	left := r.streams[id]
+
+	// Streamed aggregate is terminated by "."
+	if len(left) > 0 && left[len(left)-1] < 0 && data[0] == '.' {
+		if len(data) < 3 {
+			return 0, false
+		}
+		if bytes.HasPrefix(data, []byte(".\r\n")) {
+			left = left[:len(left)-1]
+			return 3, r.done(id, left)
+		}
+	}
+
+	n, count := redisHead(data)
+	if n <= 0 {
+		return n, false
+	}
+	if count != 0 {
+		if len(left) >= RedisMaxDepth {
+			return -1, false
+		}
+		r.streams[id] = append(left, count)
+		return n, true
+	}
+
+	return n, r.done(id, left)
+}
+
+// done count the complete value in the aggregates being framed, return whether
+// the outermost one continues
+func (r *RedisParser) done(id string, left []int) bool {
+	for len(left) > 0 {
+		i := len(left) - 1
+		if left[i] < 0 {
+			break
+		}
+		if left[i]--; left[i] > 0 {
+			break
+		}
+		left = left[:i]
+	}
+	if len(left) == 0 {
+		delete(r.streams, id)
+		return false
+	}
+	r.streams[id] = left
+
+	return true
+}
+
+// redisHead return the length of the scalar value at the start of data, or the length
+// of the header of aggregate and the count of its elements, -1 if it is streamed, the
+// length is 0 if the header is incomplete and -1 if it is illegal
+func redisHead(data []byte) (int, int) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		return 0, 0
+	}
+	if end == 0 {
+		return 2, 0
+	}
+
+	line := string(data[1:end])
+	switch data[0] {
+	case RedisBulkString, RedisBulkError, RedisVerbatim:
+		if line == "?" {
+			_, n := redisParse(data, false, 0)
+			return n, 0
+		}
+		size, err := strconv.Atoi(line)
+		if err != nil {
+			return -1, 0
+		}
+		if size < 0 {
+			return end + 2, 0
+		}
+		return end + 2 + size + 2, 0
+	case RedisArray, RedisSet, RedisPush, RedisMap, RedisAttribute:
+		if line == "?" {
+			return end + 2, -1
+		}
+		count, err := strconv.Atoi(line)
+		if err != nil {
+			return -1, 0
+		}
+		if count <= 0 {
+			return end + 2, 0
+		}
+		if data[0] == RedisMap || data[0] == RedisAttribute {
+			count *= 2
+		}
+		// Attribute is followed by the value it describes
+		if data[0] == RedisAttribute {
+			count++
+		}
+		return end + 2, count
+	}
+
+	return end + 2, 0
+}
+
+// redisPartial decode the complete elements at the head of a long aggregate, return
+// the value and the count of its elements
+func redisPartial(data []byte) (*RedisValue, int) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end <= 0 {
+		return nil, 0
+	}
+
+	v := &RedisValue{Type: data[0]}
+	switch v.Type {
+	case RedisArray, RedisSet, RedisPush, RedisMap:
+	default:
+		return nil, 0
+	}
+	count, _ := strconv.Atoi(string(data[1:end]))
+	if v.Type == RedisMap {
+		count *= 2
+	}
+	for pos := end + 2; pos < len(data); {
+		e, n := redisParse(data[pos:], true, 1)
+		if n <= 0 {
+			break
+		}
+		v.Elems = append(v.Elems, e)
+		pos += n
+	}
+	if v.Type == RedisMap {
+		count /= 2
+	}
+
+	return v, count
+}
+
+// redisParse decode the first value in data and return its length, the length is
+// 0 if the value is incomplete and -1 if it is illegal, the value is built only if build
+func redisParse(data []byte, build bool, depth int) (*RedisValue, int) {
+	if depth > RedisMaxDepth {
+		return nil, -1
+	}
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		return nil, 0
+	}
+	if end == 0 {
+		return &RedisValue{Type: RedisInline}, 2
+	}
+
+	typ, line := data[0], string(data[1:end])
+	v := &RedisValue{Type: typ}
+	switch typ {
+	case RedisSimpleString, RedisError, RedisInterger, RedisDouble, RedisBoolean, RedisBigNumber:
+		if build {
+			v.Text = line
+		}
+		return v, end + 2
+	case RedisNull:
+		v.Null = true
+		return v, end + 2
+	case RedisBulkString, RedisBulkError, RedisVerbatim:
+		if line == "?" {
+			return redisChunks(v, data, end+2, build)
+		}
+		size, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, -1
+		}
+		if size < 0 {
+			v.Null = true
+			return v, end + 2
+		}
+		if len(data) < end+2+size+2 {
+			return nil, 0
+		}
+		if build {
+			v.Text = string(data[end+2 : end+2+size])
+			// Verbatim string is prefixed with its format like "txt:"
+			if typ == RedisVerbatim && len(v.Text) >= 4 && v.Text[3] == ':' {
+				v.Text = v.Text[4:]
+			}
+		}
+		return v, end + 2 + size + 2
+	case RedisArray, RedisSet, RedisPush, RedisMap, RedisAttribute:
+		pos := end + 2
+		if line == "?" {
+			// Streamed aggregate is terminated by "."
+			for {
+				if len(data) < pos+3 {
+					return nil, 0
+				}
+				if bytes.HasPrefix(data[pos:], []byte(".\r\n")) {
+					pos += 3
+					break
 				}
-				if lines[i][0] == RedisBulkString && i-1 > 0 && lines[i-1][0] == RedisArray {
-					i = i - 1
-					continue
+				e, n := redisParse(data[pos:], build, depth+1)
+				if n <= 0 {
+					return nil, n
 				}
-				cmds = append(cmds, lines[i])
+				pos += n
+				if build {
+					v.Elems = append(v.Elems, e)
+				}
+			}
+		} else {
+			count, err := strconv.Atoi(line)
+			if err != nil {
+				return nil, -1
+			}
+			if count < 0 {
+				v.Null = true
+				return v, pos
+			}
+			if typ == RedisMap || typ == RedisAttribute {
+				count *= 2
+			}
+			for i := 0; i < count; i++ {
+				e, n := redisParse(data[pos:], build, depth+1)
+				if n <= 0 {
+					return nil, n
+				}
+				pos += n
+				if build {
+					v.Elems = append(v.Elems, e)
+				}
+			}
+		}
+
+		// Attribute is followed by the value it describes
+		if typ == RedisAttribute {
+			e, n := redisParse(data[pos:], build, depth+1)
+			if n <= 0 {
+				return nil, n
 			}
-		default:
-			cmds = append(cmds, strings.ReplaceAll(p, "\r\n", " "))
+			return e, pos + n
+		}
+		return v, pos
+	}
+
+	// Inline command
+	v.Type = RedisInline
+	if build {
+		v.Text = string(data[:end])
+	}
+	return v, end + 2
+}
+
+// redisChunks decode the chunks of streamed string from pos, which are terminated by ";0"
+func redisChunks(v *RedisValue, data []byte, pos int, build bool) (*RedisValue, int) {
+	var b strings.Builder
+	for {
+		end := bytes.Index(data[pos:], []byte("\r\n"))
+		if end < 0 {
+			return nil, 0
+		}
+		if end < 2 || data[pos] != ';' {
+			return nil, -1
 		}
+		size, err := strconv.Atoi(string(data[pos+1 : pos+end]))
+		if err != nil || size < 0 {
+			return nil, -1
+		}
+		pos += end + 2
+		if size == 0 {
+			break
+		}
+		if len(data) < pos+size+2 {
+			return nil, 0
+		}
+		if build {
+			b.Write(data[pos : pos+size])
+		}
+		pos += size + 2
+	}
+	v.Text = b.String()
+
+	return v, pos
+}
+
+// redisText render the value until the content is long enough
+func redisText(b *strings.Builder, v *RedisValue) {
+	if v.Null {
+		b.WriteString("(nil)")
+		return
+	}
+
+	switch v.Type {
+	case RedisBulkString, RedisVerbatim:
+		b.WriteString(redisQuote(v.Text))
+	case RedisBoolean:
+		b.WriteString(strconv.FormatBool(v.Text == "t"))
+	case RedisArray, RedisSet, RedisPush:
+		b.WriteByte('[')
+		for i, e := range v.Elems {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			if b.Len() > RedisContentSize {
+				break
+			}
+			redisText(b, e)
+		}
+		b.WriteByte(']')
+	case RedisMap:
+		b.WriteByte('{')
+		for i := 0; i+1 < len(v.Elems); i += 2 {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			if b.Len() > RedisContentSize {
+				break
+			}
+			redisText(b, v.Elems[i])
+			b.WriteString(": ")
+			redisText(b, v.Elems[i+1])
+		}
+		b.WriteByte('}')
+	default:
+		b.WriteString(v.Text)
+	}
+}
+
+// redisQuote quote the binary or blank string
+func redisQuote(v string) string {
+	if v == "" {
+		return `""`
+	}
+	for _, c := range v {
+		if c <= ' ' || c == '"' || c > '~' {
+			return strconv.Quote(v)
+		}
+	}
+
+	return v
+}
+
+// redisTruncate truncate the long content
+func redisTruncate(v string) string {
+	if len(v) > RedisContentSize {
+		return v[:RedisContentSize] + "..."
 	}
 
-	v.Content = strings.Join(cmds, " ")
+	return v
 }
@@ -1,20 +1,42 @@
 package src
 
+import (
+	"io"
+	"runtime"
+)
+
 // Conf conf
 type Conf struct {
-	InterFile     string // Network interface or offline pcap file
-	Outfile       string // Save the capture packet file
-	FilterIPs     string // Filtering IPs in packets
-	FilterPorts   string // Filtering Ports in packets
-	FilterCustom  string // Custom filtering rules
-	Protocol      string // Application layer protocol of data packet
-	Script        string // Lua script for parsing packets
-	SlowThreshold int64  // Threshold for slow requests
-	Duration      int64  // Time of continuous data capture
-	ShowReply     bool   // Whether to display the content of the reply packet
-	SnapLen       int    // Capture the data length of the packet
-	ReadTimeout   int64  // Timeout for reading packets from NIC
-	Promisc       bool   // Whether to use promisc mode to monitor packets
+	InterFile     string    // Network interface or offline pcap file
+	Outfile       string    // Save the capture packet file
+	FilterIPs     string    // Filtering IPs in packets
+	FilterPorts   string    // Filtering Ports in packets
+	FilterCustom  string    // Custom filtering rules
+	Protocol      string    // Application layer protocol of data packet
+	Script        string    // Lua script for parsing packets
+	SlowThreshold int64     // Threshold for slow requests
+	Duration      int64     // Time of continuous data capture
+	ShowReply     bool      // Whether to display the content of the reply packet
+	SnapLen       int       // Capture the data length of the packet
+	ReadTimeout   int64     // Timeout for reading packets from NIC
+	Promisc       bool      // Whether to use promisc mode to monitor packets
+	Workers       int       // Number of workers decoding packets in parallel
+	MetricsAddr   string    // Listen address of the prometheus metrics endpoint
+	Format        string    // Output format of the slow requests
+	TopN          int       // Number of the slowest server and command pairs in summary
+	StatsFile     string    // Save the stats into file on exit
+	MergeFiles    string    // Stats files to merge and report instead of capturing
+	Interval      int64     // Interval for reporting the rolling stats
+	TUI           bool      // Show the live terminal ui instead of the slow log
+	PacketCount   int64     // Stop after capturing the number of packets
+	MatchCount    int64     // Stop after matching the number of request/response pairs
+	Writer        io.Writer // Writer of the slow log and interval stats, default stdout
+	OutfileSize   int64     // Rotate the capture file when its size exceeds (MB)
+	OutfileAge    int64     // Rotate the capture file when its packets span longer than (second)
+	OutfileCount  int       // Keep the latest capture files only
+	RingSize      int64     // Keep the latest packets in memory and save them when slow requests are detected (MB)
+	OutfileMode   string    // Save all packets, or only the ones of slow requests or their connections
+	Routes        string    // Route patterns of http paths splited with commas, such as /users/{id}
 }
 
 // NewConf new conf
@@ -26,5 +48,9 @@ func NewConf() *Conf {
 		SnapLen:       1500,
 		Promisc:       false,
 		ReadTimeout:   30,
+		Workers:       runtime.NumCPU(),
+		Format:        "text",
+		TopN:          10,
+		OutfileMode:   SaveAll,
 	}
 }
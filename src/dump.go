@@ -0,0 +1,205 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// StatsVersion version of the serialized stats
+const StatsVersion = 1
+
+// StatsDump stats of a capture in the exported and serialized form
+type StatsDump struct {
+	Version  int           `json:"version"`
+	Protocol string        `json:"protocol"`
+	Request  int64         `json:"request"`
+	Response int64         `json:"response"`
+	Slow     int64         `json:"slow"`
+	Errors   int64         `json:"errors"`
+	Cost     time.Duration `json:"cost"`
+	Process  time.Duration `json:"process"`
+	RTT      time.Duration `json:"rtt"`
+	RTTs     int64         `json:"rtts"`
+	Buckets  []int64       `json:"buckets"`
+	Latency  *Histogram    `json:"latency"`
+	Metrics  []*MetricDump `json:"metrics"`
+	Statuses []*MetricDump `json:"statuses,omitempty"`
+}
+
+// MetricDump serialized stats of the server and command
+type MetricDump struct {
+	Server  string        `json:"server"`
+	Command string        `json:"command"`
+	Status  string        `json:"status,omitempty"`
+	Request int64         `json:"request"`
+	Count   int64         `json:"count"`
+	Slow    int64         `json:"slow"`
+	Errors  int64         `json:"errors"`
+	Cost    time.Duration `json:"cost"`
+	Buckets []int64       `json:"buckets"`
+	Latency *Histogram    `json:"latency"`
+}
+
+// Save serialize the stats as json
+func (s *State) Save(w io.Writer) error {
+	return json.NewEncoder(w).Encode(s.Dump())
+}
+
+// Dump copy the stats into the exported form
+func (s *State) Dump() *StatsDump {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := &StatsDump{
+		Version:  StatsVersion,
+		Protocol: s.protocol,
+		Request:  s.request,
+		Response: s.response,
+		Slow:     s.slow,
+		Errors:   s.errors,
+		Cost:     s.cost,
+		Process:  s.process,
+		RTT:      s.rtt,
+		RTTs:     s.rtts,
+		Latency:  NewHistogram(),
+	}
+	d.Latency.Merge(s.hist)
+	for _, b := range s.bks {
+		d.Buckets = append(d.Buckets, b.v)
+	}
+	for _, m := range s.metrics {
+		d.Metrics = append(d.Metrics, m.dump())
+	}
+	for _, m := range s.statuses {
+		d.Statuses = append(d.Statuses, m.dump())
+	}
+
+	return d
+}
+
+// dump copy the stats of metric into the exported form
+func (m *Metric) dump() *MetricDump {
+	dm := &MetricDump{
+		Server:  m.server,
+		Command: m.command,
+		Status:  m.status,
+		Request: m.request,
+		Count:   m.count,
+		Slow:    m.slow,
+		Errors:  m.errors,
+		Cost:    m.cost,
+		Buckets: append([]int64(nil), m.bks...),
+		Latency: NewHistogram(),
+	}
+	dm.Latency.Merge(m.hist)
+
+	return dm
+}
+
+// Load merge the stats serialized by Save
+func (s *State) Load(r io.Reader) error {
+	var d StatsDump
+	if e := json.NewDecoder(r).Decode(&d); e != nil {
+		return e
+	}
+	if d.Version != StatsVersion {
+		return fmt.Errorf("Not support stats version %d", d.Version)
+	}
+	if len(d.Buckets) != len(s.bks) {
+		return fmt.Errorf("Stats have %d buckets, expect %d", len(d.Buckets), len(s.bks))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d.Latency != nil {
+		if e := s.hist.Merge(d.Latency); e != nil {
+			return e
+		}
+	}
+	s.protocol = d.Protocol
+	s.request += d.Request
+	s.response += d.Response
+	s.slow += d.Slow
+	s.errors += d.Errors
+	s.cost += d.Cost
+	s.process += d.Process
+	s.rtt += d.RTT
+	s.rtts += d.RTTs
+	for i, n := range d.Buckets {
+		s.bks[i].v += n
+	}
+
+	for _, dm := range d.Metrics {
+		if e := s.load(s.metric(dm.Server, dm.Command), dm); e != nil {
+			return e
+		}
+	}
+	for _, dm := range d.Statuses {
+		if e := s.load(s.statusMetric(dm.Server, dm.Command, dm.Status), dm); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// load merge the serialized stats into metric
+func (s *State) load(m *Metric, dm *MetricDump) error {
+	if len(dm.Buckets) != len(s.bks) {
+		return fmt.Errorf("Stats of %s %s have %d buckets, expect %d", dm.Server, dm.Command, len(dm.Buckets), len(s.bks))
+	}
+	if dm.Latency != nil {
+		if e := m.hist.Merge(dm.Latency); e != nil {
+			return e
+		}
+	}
+	m.request += dm.Request
+	m.count += dm.Count
+	m.slow += dm.Slow
+	m.errors += dm.Errors
+	m.cost += dm.Cost
+	for i, n := range dm.Buckets {
+		m.bks[i] += n
+	}
+
+	return nil
+}
+
+// SaveStats save the stats into file
+func (s *State) SaveStats(path string) error {
+	f, e := os.Create(path)
+	if e != nil {
+		return fmt.Errorf("Create stats file %s failed: %v", path, e)
+	}
+	defer f.Close()
+
+	return s.Save(f)
+}
+
+// ReportStats merge the stats files splited with commas and show the summary
+func ReportStats(c *Conf, files string) error {
+	s, e := NewState(c)
+	if e != nil {
+		return e
+	}
+
+	for _, path := range strings.Split(files, ",") {
+		f, e := os.Open(strings.TrimSpace(path))
+		if e != nil {
+			return fmt.Errorf("Open stats file %s failed: %v", path, e)
+		}
+		e = s.Load(f)
+		f.Close()
+		if e != nil {
+			return fmt.Errorf("Load stats file %s failed: %v", path, e)
+		}
+	}
+	s.ShowStats()
+
+	return nil
+}
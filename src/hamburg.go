@@ -1,13 +1,17 @@
 package src
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	p "github.com/bugwz/hamburg/parser"
+	u "github.com/bugwz/hamburg/utils"
 	"github.com/google/gopacket"
 )
 
@@ -15,17 +19,31 @@ import (
 const (
 	SignalExit  = 1
 	TimeoutExit = 2
+	CountExit   = 3
+	EOFExit     = 4
+	CancelExit  = 5
 )
 
 // Hamburg main
 type Hamburg struct {
 	Sniffer *Sniffer
-	Parser  *Parser
-	State   *State
+	Workers []*Worker // Decode workers sharded by flow hash
+	State   *State    // Stats merged from all workers
 	Done    chan int
+	conf    *Conf
+	output  *Output
+	tui     *TUI                 // Live terminal ui
+	hooks   *Hooks               // Callbacks shared by workers
+	metrics net.Listener         // Listener of the prometheus metrics endpoint
+	packets chan gopacket.Packet // Packets read from the capture handle
+	sharder *Sharder             // Hash the flows of packets for workers
+	quit    chan bool            // Closed to stop the scheduler
+	count   int64                // Total captured packets
+	matched int64                // Total matched request/response pair, updated by workers
+	wg      sync.WaitGroup
 }
 
-// NewHamburg new hamburg
+// NewHamburg new hamburg, register the hooks before running it
 func NewHamburg(c *Conf) (*Hamburg, error) {
 	if c == nil {
 		return nil, fmt.Errorf("Conf is nil")
@@ -36,7 +54,18 @@ func NewHamburg(c *Conf) (*Hamburg, error) {
 		return nil, e
 	}
 
-	parser, e := NewParser(c)
+	h, e := newHamburg(c, sniffer)
+	if e != nil {
+		sniffer.Close()
+		return nil, e
+	}
+
+	return h, nil
+}
+
+// newHamburg create the output, state and workers of the sniffer
+func newHamburg(c *Conf, sniffer *Sniffer) (*Hamburg, error) {
+	output, e := NewOutput(c)
 	if e != nil {
 		return nil, e
 	}
@@ -46,167 +75,254 @@ func NewHamburg(c *Conf) (*Hamburg, error) {
 		return nil, e
 	}
 
-	return &Hamburg{
+	h := &Hamburg{
 		Sniffer: sniffer,
-		Parser:  parser,
 		State:   state,
-		Done:    make(chan int),
-	}, nil
+		Done:    make(chan int, 1),
+		conf:    c,
+		output:  output,
+		hooks:   &Hooks{},
+		quit:    make(chan bool),
+	}
+	h.hooks.match = h.countMatch
+
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+	h.Workers = make([]*Worker, c.Workers)
+	for i := range h.Workers {
+		if h.Workers[i], e = NewWorker(c, sniffer, output, h.hooks); e != nil {
+			for _, w := range h.Workers[:i] {
+				w.Parser.CloseScript()
+			}
+			return nil, e
+		}
+	}
+
+	return h, nil
 }
 
-// Run run
+// Run capture and analyze the packets until exit, then print the summary
 func (h *Hamburg) Run() {
-	// 1) Output NIC information
+	// Output NIC information
 	h.Sniffer.NICDetail()
 
+	// Exit for signal
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(ch)
+	go func() {
+		select {
+		case <-ch:
+			h.Exit(SignalExit)
+		case <-h.quit:
+		}
+	}()
+
+	exit, e := h.run(context.Background())
+	if e != nil {
+		fmt.Println(e)
+	}
+	switch exit {
+	case SignalExit:
+		fmt.Println("\r\nWill exit for signal...")
+	case TimeoutExit:
+		fmt.Println("\r\nWill exit for run timeout...")
+	case CountExit:
+		fmt.Println("\r\nWill exit for count limit...")
+	case EOFExit:
+		fmt.Println("\r\nWill exit for end of file...")
+	default:
+		return
+	}
+	h.State.ShowStats()
+	if h.conf.StatsFile != "" {
+		if e := h.State.SaveStats(h.conf.StatsFile); e != nil {
+			fmt.Println(e)
+		}
+	}
+}
+
+// RunContext capture and analyze the packets until the context is done or the limits
+// in conf are reached, the resources are released before return and the merged stats
+// are kept in State, the error is the error of context if it is done
+func (h *Hamburg) RunContext(ctx context.Context) error {
+	exit, e := h.run(ctx)
+	if e != nil {
+		return e
+	}
+	if exit == CancelExit {
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// run capture packets until exit and release the resources, return the exit flag
+func (h *Hamburg) run(ctx context.Context) (int, error) {
+	// 1) Expose the stats for prometheus
+	if h.conf.MetricsAddr != "" {
+		if e := h.ServeMetrics(h.conf.MetricsAddr); e != nil {
+			h.closeScripts()
+			h.Close()
+			return 0, e
+		}
+	}
+
+	// Take over the screen with the terminal ui
+	if h.conf.TUI {
+		t, e := NewTUI(h)
+		if e != nil {
+			h.closeScripts()
+			h.Close()
+			return 0, e
+		}
+		h.tui = t
+		go t.Run()
+	}
+
 	// 2) Set start time
 	h.Sniffer.SetStartTime()
 
 	// 3) Run scheduler
 	h.Scheduler()
 
-	// 4) Start capture packets
-	ps := gopacket.NewPacketSource(h.Sniffer.pktreader, h.Sniffer.pktreader.LinkType())
+	// 4) Run decode workers
+	for _, w := range h.Workers {
+		h.wg.Add(1)
+		go w.Run(&h.wg)
+	}
+
+	// 5) Start capture packets, only the headers for sharding are decoded here and
+	// the layers are decoded lazily by workers
+	h.sharder = NewSharder(h.Sniffer.linktype)
+	ps := gopacket.NewPacketSource(h.Sniffer.pktreader, u.LinkDecoder(h.Sniffer.linktype))
+	ps.Lazy = true
+	ps.NoCopy = true
+	h.packets = ps.Packets()
+	exit := h.capture(ctx)
+
+	// 6) Drain the in-flight packets and merge the stats
+	h.Stop()
+	if h.tui != nil {
+		h.tui.Close()
+	}
+
+	// 7) Release the resources
+	return exit, h.Close()
+}
+
+// capture dispatch the packets until exit and return the exit flag
+func (h *Hamburg) capture(ctx context.Context) int {
+	limit := h.conf.PacketCount
 	for {
 		select {
+		case <-ctx.Done():
+			return CancelExit
 		case exit := <-h.Done:
-			switch exit {
-			case SignalExit:
-				fmt.Println("\r\nWill exit for signal...")
-			case TimeoutExit:
-				fmt.Println("\r\nWill exit for run timeout...")
+			return exit
+		case p, ok := <-h.packets:
+			if !ok {
+				return EOFExit
+			}
+			h.Dispatch(p)
+			if h.count++; limit > 0 && h.count >= limit {
+				return CountExit
 			}
-			h.State.ShowStats()
-			os.Exit(0)
-		case p := <-ps.Packets():
-			h.SavePackets(&p)
-			h.ParsePackets(&p)
 		}
 	}
 }
 
-// Scheduler schedule process
-func (h *Hamburg) Scheduler() {
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		for {
-			select {
-			case <-ch:
-				h.Done <- SignalExit
-				return
-			case <-time.After(time.Duration(1) * time.Second):
-				start := h.Sniffer.GetStartTime()
-				limit := h.Sniffer.GetDuration()
-				if limit != 0 && time.Now().Sub(start) >= limit {
-					h.Done <- TimeoutExit
-					return
-				}
-			}
-		}
-	}()
+// Exit stop capturing with the exit flag, only the first flag takes effect
+func (h *Hamburg) Exit(flag int) {
+	select {
+	case h.Done <- flag:
+	default:
+	}
 }
 
-// ParsePackets parser packets
-func (h *Hamburg) ParsePackets(gop *gopacket.Packet) {
-	// 1) Parsing layers of packets
-	pkt := h.Parser.UnpackLayers(gop)
-
-	// 2) Determine the direction of the data
-	h.SetDirection(pkt)
+// countMatch count the matched request and exit when the limit is reached
+func (h *Hamburg) countMatch() {
+	n := atomic.AddInt64(&h.matched, 1)
+	if h.conf.MatchCount > 0 && n >= h.conf.MatchCount {
+		h.Exit(CountExit)
+	}
+}
 
-	// 3) Update process status
-	h.State.IncrReqRsp(pkt.Request)
+// Dispatch send the packet to the worker of its innermost flow, both directions
+// of a connection share the same worker so that its packets stay ordered
+func (h *Hamburg) Dispatch(pkt gopacket.Packet) {
+	hash := h.sharder.Hash(pkt)
+	h.Workers[hash%uint64(len(h.Workers))].packets <- pkt
+}
 
-	// 4) Try run custom script
-	if h.Parser.RunScript(pkt) == nil {
-		return
+// Stop wait for the workers to drain their queues and merge their stats
+func (h *Hamburg) Stop() {
+	for _, w := range h.Workers {
+		close(w.packets)
 	}
+	h.wg.Wait()
 
-	// 5) Run the preset parsing script
-	h.Parser.Run(pkt)
-
-	// 6) Processing request and reply packet pairs
-	if pkt.Ignore {
-		return
+	for _, w := range h.Workers {
+		h.State.Merge(w.State)
 	}
+}
 
-	reqid := fmt.Sprintf("%s -> %s", pkt.SrcID, pkt.DstID)
-	rspid := fmt.Sprintf("%s -> %s", pkt.DstID, pkt.SrcID)
-	if pkt.Payload == "" {
-		if pkt.Request && pkt.Flag&SYN != 0 {
-			h.State.dict.Remove(reqid)
-		}
-		if !pkt.Request && (pkt.Flag&RST != 0 || pkt.Flag&FIN != 0) {
-			h.State.dict.Remove(rspid)
-		}
-		return
+// Close stop the scheduler and metrics endpoint, flush the saved packets and close the capture handle
+func (h *Hamburg) Close() error {
+	close(h.quit)
+	if h.metrics != nil {
+		h.metrics.Close()
 	}
 
-	if pkt.Request {
-		old, exits := h.State.dict.Get(reqid)
-		if !exits {
-			h.State.dict.Put(reqid, pkt)
-		} else {
-			old.(*p.Packet).Content += " " + pkt.Content
-		}
-	} else {
-		if ret, ok := h.State.dict.Get(rspid); ok {
-			td := pkt.Timestap.Sub(ret.(*p.Packet).Timestap)
-			h.State.AddDuration(td)
-			if h.State.FitSlow(td) {
-				h.State.curmsg = fmt.Sprintf("%v | %s | %v | %v",
-					(ret.(*p.Packet).Timestap).Format("2006-01-02 15:04:05"), rspid, td,
-					ret.(*p.Packet).Content)
-				if h.State.showreply {
-					h.State.curmsg += fmt.Sprintf(" | %v", pkt.Content)
-				}
-				fmt.Println(h.State.curmsg)
-			}
-			h.State.dict.Remove(rspid)
+	// The packet source stops once the handle is closed, unblock it by draining the packets
+	done := make(chan error)
+	go func() {
+		done <- h.Sniffer.Close()
+	}()
+	if h.packets != nil {
+		for range h.packets {
 		}
-		// TODO: The statistical time-consuming of multiple reply packets may be small
 	}
+
+	return <-done
 }
 
-// SavePackets save packets to local file
-func (h *Hamburg) SavePackets(p *gopacket.Packet) {
-	s := h.Sniffer
-	if s != nil && s.pktwriter != nil {
-		s.pktwriter.WritePacket((*p).Metadata().CaptureInfo, (*p).Data())
+// closeScripts close the lua states of the workers which are not started
+func (h *Hamburg) closeScripts() {
+	for _, w := range h.Workers {
+		w.Parser.CloseScript()
 	}
 }
 
-// SetDirection set request direction
-func (h *Hamburg) SetDirection(v *p.Packet) {
-	// Using IP to determine the request direction of packets
-	if h.Sniffer.localip[v.SrcIP] != "" {
-		v.Request = false
-	}
-	if h.Sniffer.localip[v.DstIP] != "" {
-		v.Request = true
+// Scheduler schedule process
+func (h *Hamburg) Scheduler() {
+	// Report the rolling stats periodically
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	if h.conf.Interval > 0 {
+		ticker = time.NewTicker(time.Duration(h.conf.Interval) * time.Second)
+		tick = ticker.C
 	}
-
-	// Using Port to determine the request direction of packets
-	if v.SrcPort != "" && v.DstPort != "" {
-		for _, port := range h.Sniffer.ports {
-			if v.SrcPort == port {
-				v.Request = false
-				break
-			}
-			if v.DstPort == port {
-				v.Request = true
-				break
-			}
+	go func() {
+		if ticker != nil {
+			defer ticker.Stop()
 		}
-		return
-	}
-
-	// Use recorded historical packets to determine direction
-	if v.SrcIP != "" && v.DstIP != "" {
-		reqid := fmt.Sprintf("%s:%s => %s:%s", v.DstIP, v.DstPort, v.SrcIP, v.SrcPort)
-		if _, exits := h.State.dict.Get(reqid); exits {
-			v.Request = false
+		last := time.Now()
+		for {
+			select {
+			case <-h.quit:
+				return
+			case now := <-tick:
+				h.ShowInterval(now, now.Sub(last))
+				last = now
+			case <-time.After(time.Duration(1) * time.Second):
+				start := h.Sniffer.GetStartTime()
+				limit := h.Sniffer.GetDuration()
+				if limit != 0 && time.Now().Sub(start) >= limit {
+					h.Exit(TimeoutExit)
+				}
+			}
 		}
-	}
+	}()
 }
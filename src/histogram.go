@@ -0,0 +1,154 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// HistogramAccuracy relative error of the quantiles estimated by histogram
+const HistogramAccuracy = 0.01
+
+// Histogram mergeable latency histogram with logarithmic bins like DDSketch,
+// the value v is counted in bin i where gamma^(i-1) < v <= gamma^i, so the
+// quantiles estimated by the bins have the relative error bounded by accuracy
+type Histogram struct {
+	Accuracy float64       `json:"accuracy"` // Relative error of quantiles
+	Zero     int64         `json:"zero"`     // Count of the zero values
+	Bins     map[int]int64 `json:"bins"`     // Count of the values in each bin
+	Count    int64         `json:"count"`    // Total values
+	Sum      time.Duration `json:"sum"`      // Sum of values
+	Min      time.Duration `json:"min"`      // Minimum value
+	Max      time.Duration `json:"max"`      // Maximum value
+	gamma    float64       // Ratio of the bounds of a bin
+	lngamma  float64       // Natural logarithm of gamma
+}
+
+// NewHistogram new histogram
+func NewHistogram() *Histogram {
+	h := &Histogram{Accuracy: HistogramAccuracy, Bins: make(map[int]int64)}
+	h.init()
+
+	return h
+}
+
+// init compute the bin ratio of the accuracy
+func (h *Histogram) init() {
+	h.gamma = (1 + h.Accuracy) / (1 - h.Accuracy)
+	h.lngamma = math.Log(h.gamma)
+	if h.Bins == nil {
+		h.Bins = make(map[int]int64)
+	}
+}
+
+// UnmarshalJSON decode the histogram serialized by json
+func (h *Histogram) UnmarshalJSON(b []byte) error {
+	type histogram Histogram
+	if err := json.Unmarshal(b, (*histogram)(h)); err != nil {
+		return err
+	}
+	if h.Accuracy <= 0 || h.Accuracy >= 1 {
+		return fmt.Errorf("Histogram accuracy %v is illegal", h.Accuracy)
+	}
+	h.init()
+
+	return nil
+}
+
+// Add count the value
+func (h *Histogram) Add(v time.Duration) {
+	if h.Count == 0 || v < h.Min {
+		h.Min = v
+	}
+	if v > h.Max {
+		h.Max = v
+	}
+	h.Count++
+	h.Sum += v
+
+	if v <= 0 {
+		h.Zero++
+		return
+	}
+	h.Bins[int(math.Ceil(math.Log(float64(v))/h.lngamma))]++
+}
+
+// Merge add the values of another histogram with the same accuracy
+func (h *Histogram) Merge(o *Histogram) error {
+	if o.Count == 0 {
+		return nil
+	}
+	if o.Accuracy != h.Accuracy {
+		return fmt.Errorf("Merge histogram with accuracy %v into %v", o.Accuracy, h.Accuracy)
+	}
+
+	if h.Count == 0 || o.Min < h.Min {
+		h.Min = o.Min
+	}
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+	h.Zero += o.Zero
+	for i, n := range o.Bins {
+		h.Bins[i] += n
+	}
+
+	return nil
+}
+
+// Quantile estimate the value at quantile q in [0, 1]
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	var idx []int
+	for i := range h.Bins {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+
+	rank := int64(q * float64(h.Count-1))
+	sum := h.Zero
+	if rank < sum {
+		return 0
+	}
+	for _, i := range idx {
+		sum += h.Bins[i]
+		if rank < sum {
+			return h.clamp(h.value(i))
+		}
+	}
+
+	return h.Max
+}
+
+// Mean average of the values
+func (h *Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	return h.Sum / time.Duration(h.Count)
+}
+
+// value estimation of the values in bin i with the bounded relative error
+func (h *Histogram) value(i int) time.Duration {
+	return time.Duration(2 * math.Pow(h.gamma, float64(i)) / (h.gamma + 1))
+}
+
+// clamp limit the estimation within the minimum and maximum value
+func (h *Histogram) clamp(v time.Duration) time.Duration {
+	if v < h.Min {
+		return h.Min
+	}
+	if v > h.Max {
+		return h.Max
+	}
+
+	return v
+}
@@ -0,0 +1,29 @@
+package src
+
+import (
+	p "github.com/bugwz/hamburg/parser"
+)
+
+// Hooks callbacks of the captured packets and matched requests, they are called
+// from the workers concurrently and must not modify the packets or events
+type Hooks struct {
+	Packet      func(v *p.Packet) // Each captured packet with its layers decoded
+	Transaction func(e *Event)    // Each matched request/response pair
+	Slow        func(e *Event)    // Each request/response pair slower than the threshold
+	match       func()            // Count the matched pairs for the limit
+}
+
+// OnPacket register the callback of captured packets, it must be called before running
+func (h *Hamburg) OnPacket(f func(v *p.Packet)) {
+	h.hooks.Packet = f
+}
+
+// OnTransaction register the callback of matched request/response pairs, it must be called before running
+func (h *Hamburg) OnTransaction(f func(e *Event)) {
+	h.hooks.Transaction = f
+}
+
+// OnSlow register the callback of slow requests, it must be called before running
+func (h *Hamburg) OnSlow(f func(e *Event)) {
+	h.hooks.Slow = f
+}
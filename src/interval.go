@@ -0,0 +1,91 @@
+package src
+
+import (
+	"time"
+)
+
+// IntervalHeaderLines lines of interval stats between two headers in text format
+const IntervalHeaderLines = 20
+
+// Interval stats of the requests since the last report
+type Interval struct {
+	request int64      // Total request
+	count   int64      // Total request/response pair
+	slow    int64      // Total slow request/response
+	errors  int64      // Total error response
+	hist    *Histogram // Latency histogram
+}
+
+// IntervalStats rolling stats reported periodically
+type IntervalStats struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Interval  float64   `json:"interval_s"`
+	QPS       float64   `json:"qps"`
+	Request   int64     `json:"requests"`
+	Response  int64     `json:"responses"`
+	Slow      int64     `json:"slow"`
+	Errors    int64     `json:"errors"`
+	ErrorRate float64   `json:"error_rate"`
+	P50       int64     `json:"p50_us"`
+	P99       int64     `json:"p99_us"`
+	Max       int64     `json:"max_us"`
+}
+
+// NewInterval new interval
+func NewInterval() *Interval {
+	return &Interval{hist: NewHistogram()}
+}
+
+// Merge add the stats of another interval
+func (i *Interval) Merge(o *Interval) {
+	i.request += o.request
+	i.count += o.count
+	i.slow += o.slow
+	i.errors += o.errors
+	i.hist.Merge(o.hist)
+}
+
+// Stats summarize the interval which lasts for d
+func (i *Interval) Stats(now time.Time, d time.Duration) *IntervalStats {
+	r := &IntervalStats{
+		Type:     "interval",
+		Time:     now,
+		Interval: d.Seconds(),
+		Request:  i.request,
+		Response: i.count,
+		Slow:     i.slow,
+		Errors:   i.errors,
+		P50:      i.hist.Quantile(0.5).Microseconds(),
+		P99:      i.hist.Quantile(0.99).Microseconds(),
+		Max:      i.hist.Max.Microseconds(),
+	}
+	if d > 0 {
+		r.QPS = float64(i.request) / d.Seconds()
+	}
+	if i.count > 0 {
+		r.ErrorRate = float64(i.errors) / float64(i.count)
+	}
+
+	return r
+}
+
+// TakeInterval return the stats since the last call and start a new interval
+func (s *State) TakeInterval() *Interval {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.interval
+	s.interval = NewInterval()
+
+	return i
+}
+
+// ShowInterval merge and report the interval stats of all workers
+func (h *Hamburg) ShowInterval(now time.Time, d time.Duration) {
+	i := NewInterval()
+	for _, w := range h.Workers {
+		i.Merge(w.State.TakeInterval())
+	}
+	h.output.WriteInterval(i.Stats(now, d))
+}
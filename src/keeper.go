@@ -0,0 +1,174 @@
+package src
+
+import (
+	"container/list"
+	"time"
+
+	p "github.com/bugwz/hamburg/parser"
+	u "github.com/bugwz/hamburg/utils"
+	"github.com/google/gopacket"
+)
+
+// Modes of saving packets into outfile
+const (
+	SaveAll  = "all"  // All captured packets
+	SaveSlow = "slow" // Packets of the slow request/response pairs
+	SaveConn = "conn" // Packets of the connections with slow request/response pairs
+)
+
+// MaxKeptBytes packets kept for each connection before the oldest ones are dropped
+const MaxKeptBytes = 4 << 20
+
+// MaxKeeperBytes packets kept for all connections of a keeper before the least recently
+// active connections are dropped
+const MaxKeeperBytes = 64 << 20
+
+// KeptIdleTimeout connections without packets for the timeout are dropped, such as
+// the udp flows and the connections whose FIN was not captured
+const KeptIdleTimeout = 5 * time.Minute
+
+// KeptPacket packet kept until its request is known to be slow or not
+type KeptPacket struct {
+	ci       gopacket.CaptureInfo
+	data     []byte
+	comments []string // Annotations of the packet
+	saved    bool     // Whether saved with another slow request
+}
+
+// Kept packets kept for a connection
+type Kept struct {
+	id      string        // Connection id
+	packets []*KeptPacket // Packets in capture order
+	size    int64         // Bytes of the packets kept
+	saving  bool          // Whether all packets of the connection are saved
+	last    time.Time     // Capture time of the latest packet
+	elem    *list.Element // Element in the list of recently active connections
+}
+
+// Keeper keep the packets of each connection, and save the ones of slow requests
+type Keeper struct {
+	mode   string
+	writer *u.PacketWriter
+	conns  map[string]*Kept // Connections indexed by "client -> server"
+	recent *list.List       // Connections from the most to the least recently active
+	size   int64            // Bytes of the packets kept for all connections
+}
+
+// NewKeeper new keeper
+func NewKeeper(mode string, writer *u.PacketWriter) *Keeper {
+	return &Keeper{
+		mode:   mode,
+		writer: writer,
+		conns:  make(map[string]*Kept),
+		recent: list.New(),
+	}
+}
+
+// Add keep the packet of connection id, or save it directly if the whole connection is saved
+func (k *Keeper) Add(id string, ci gopacket.CaptureInfo, data []byte, comments []string) {
+	c := k.conns[id]
+	if c == nil {
+		c = &Kept{id: id}
+		c.elem = k.recent.PushFront(c)
+		k.conns[id] = c
+	} else {
+		k.recent.MoveToFront(c.elem)
+	}
+	c.last = ci.Timestamp
+	defer k.expire(ci.Timestamp)
+
+	if c.saving {
+		k.writer.WritePacket(ci, data, comments)
+		return
+	}
+
+	c.packets = append(c.packets, &KeptPacket{ci: ci, data: data, comments: comments})
+	c.size += int64(len(data))
+	k.size += int64(len(data))
+	k.trim(c, func(pkt *KeptPacket) bool { return c.size > MaxKeptBytes })
+}
+
+// expire drop the idle connections, and the least recently active ones while the
+// packets kept are beyond the budget of keeper
+func (k *Keeper) expire(now time.Time) {
+	for e := k.recent.Back(); e != nil && e != k.recent.Front(); e = k.recent.Back() {
+		c := e.Value.(*Kept)
+		if k.size <= MaxKeeperBytes && now.Sub(c.last) < KeptIdleTimeout {
+			break
+		}
+		k.Close(c.id)
+	}
+
+	// The only connection left keeps its latest packets
+	if e := k.recent.Front(); e != nil && k.size > MaxKeeperBytes {
+		k.trim(e.Value.(*Kept), func(pkt *KeptPacket) bool { return k.size > MaxKeeperBytes })
+	}
+}
+
+// trim drop the oldest packets of the connection while drop returns true, the latest
+// packet is always kept
+func (k *Keeper) trim(c *Kept, drop func(pkt *KeptPacket) bool) {
+	n := 0
+	for n < len(c.packets)-1 && drop(c.packets[n]) {
+		c.size -= int64(len(c.packets[n].data))
+		k.size -= int64(len(c.packets[n].data))
+		c.packets[n] = nil
+		n++
+	}
+	c.packets = c.packets[n:]
+}
+
+// Save save the packets since the slow request, whose reply is completed by the
+// latest packet, or all packets of the connection
+func (k *Keeper) Save(id string, req *p.Packet) {
+	c := k.conns[id]
+	if c == nil || c.saving {
+		return
+	}
+
+	for _, pkt := range c.packets {
+		if pkt.saved || k.mode == SaveSlow && pkt.ci.Timestamp.Before(req.Timestap) {
+			continue
+		}
+		k.writer.WritePacket(pkt.ci, pkt.data, pkt.comments)
+		pkt.saved = true
+	}
+	if k.mode == SaveConn {
+		c.saving = true
+		k.size -= c.size
+		c.packets, c.size = nil, 0
+	}
+}
+
+// Trim drop the packets before the oldest outstanding request of the connection,
+// or all of them if there is none, the whole connection is kept until its first
+// slow request in SaveConn mode
+func (k *Keeper) Trim(id string, oldest time.Time, pending bool) {
+	c := k.conns[id]
+	if c == nil || k.mode == SaveConn {
+		return
+	}
+	if !pending {
+		k.size -= c.size
+		c.packets, c.size = nil, 0
+		return
+	}
+
+	drop := 0
+	for drop < len(c.packets) && c.packets[drop].ci.Timestamp.Before(oldest) {
+		c.size -= int64(len(c.packets[drop].data))
+		k.size -= int64(len(c.packets[drop].data))
+		c.packets[drop] = nil
+		drop++
+	}
+	c.packets = c.packets[drop:]
+}
+
+// Close release the packets of the closed connection
+func (k *Keeper) Close(id string) {
+	if c := k.conns[id]; c != nil {
+		k.size -= c.size
+		k.recent.Remove(c.elem)
+		delete(k.conns, id)
+	}
+}
@@ -0,0 +1,107 @@
+package src
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// MetricsPath path of the prometheus metrics endpoint
+const MetricsPath = "/metrics"
+
+// ServeMetrics expose the stats in prometheus text format
+func (h *Hamburg) ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(MetricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		h.Snapshot().WriteMetrics(w)
+	})
+
+	ln, e := net.Listen("tcp", addr)
+	if e != nil {
+		return fmt.Errorf("Listen metrics endpoint %s failed: %v", addr, e)
+	}
+	h.metrics = ln
+	go http.Serve(ln, mux)
+
+	return nil
+}
+
+// Snapshot merge the stats of all workers
+func (h *Hamburg) Snapshot() *State {
+	s, _ := NewState(h.conf)
+	for _, w := range h.Workers {
+		s.Merge(w.State)
+	}
+
+	return s
+}
+
+// WriteMetrics write the stats in prometheus text format
+func (s *State) WriteMetrics(w io.Writer) {
+	b := bufio.NewWriter(w)
+	defer b.Flush()
+
+	var metrics []*Metric
+	for _, m := range s.metrics {
+		metrics = append(metrics, m)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].server != metrics[j].server {
+			return metrics[i].server < metrics[j].server
+		}
+		return metrics[i].command < metrics[j].command
+	})
+
+	fmt.Fprintln(b, "# HELP hamburg_packets_total Captured packets by direction.")
+	fmt.Fprintln(b, "# TYPE hamburg_packets_total counter")
+	fmt.Fprintf(b, "hamburg_packets_total{protocol=\"%s\",direction=\"request\"} %d\n", escape(s.protocol), s.request)
+	fmt.Fprintf(b, "hamburg_packets_total{protocol=\"%s\",direction=\"response\"} %d\n", escape(s.protocol), s.response)
+
+	counters := []struct {
+		name, help string
+		value      func(m *Metric) int64
+	}{
+		{"hamburg_requests_total", "Parsed requests.", func(m *Metric) int64 { return m.request }},
+		{"hamburg_responses_total", "Responses matched with their request.", func(m *Metric) int64 { return m.count }},
+		{"hamburg_slow_total", "Responses slower than the threshold.", func(m *Metric) int64 { return m.slow }},
+		{"hamburg_errors_total", "Responses reporting an error.", func(m *Metric) int64 { return m.errors }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(b, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(b, "# TYPE %s counter\n", c.name)
+		for _, m := range metrics {
+			fmt.Fprintf(b, "%s{%s} %d\n", c.name, s.labels(m), c.value(m))
+		}
+	}
+
+	// The buckets of State.bks are lower bounds, prometheus buckets are upper bounds
+	fmt.Fprintln(b, "# HELP hamburg_latency_seconds Latency of request/response pairs.")
+	fmt.Fprintln(b, "# TYPE hamburg_latency_seconds histogram")
+	for _, m := range metrics {
+		labels := s.labels(m)
+		var sum int64
+		for i := 0; i < len(s.bks)-1; i++ {
+			sum += m.bks[i]
+			fmt.Fprintf(b, "hamburg_latency_seconds_bucket{%s,le=\"%g\"} %d\n", labels, s.bks[i+1].k.Seconds(), sum)
+		}
+		fmt.Fprintf(b, "hamburg_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, m.count)
+		fmt.Fprintf(b, "hamburg_latency_seconds_sum{%s} %g\n", labels, m.cost.Seconds())
+		fmt.Fprintf(b, "hamburg_latency_seconds_count{%s} %d\n", labels, m.count)
+	}
+}
+
+// labels prometheus labels of the metric
+func (s *State) labels(m *Metric) string {
+	return fmt.Sprintf("protocol=\"%s\",server=\"%s\",command=\"%s\"",
+		escape(s.protocol), escape(m.server), escape(m.command))
+}
+
+// escape escape the prometheus label value
+func escape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,296 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	p "github.com/bugwz/hamburg/parser"
+)
+
+// Output formats of the slow requests
+const (
+	TextFormat   = "text"
+	JSONFormat   = "json"
+	LogfmtFormat = "logfmt"
+)
+
+// RecentEvents events kept for the terminal ui
+const RecentEvents = 100
+
+// AnnotateSize maximum length of the request in the comments of saved packets
+const AnnotateSize = 256
+
+// Event matched request/response pair
+type Event struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Server   string    `json:"server"`
+	Protocol string    `json:"protocol"`
+	Command  string    `json:"command"`
+	Latency  int64     `json:"latency_us"`
+	Process  int64     `json:"process_us"`
+	RTT      int64     `json:"rtt_us,omitempty"`
+	ReqSize  int       `json:"request_size"`
+	RspSize  int       `json:"response_size"`
+	Status   string    `json:"status"`
+	Error    bool      `json:"error"`
+	Rows     int64     `json:"rows,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Database string    `json:"database,omitempty"`
+	Request  string    `json:"request"`
+	Response string    `json:"response,omitempty"`
+	cost     time.Duration
+	process  time.Duration
+	rtt      time.Duration
+}
+
+// Output write the events in the configured format
+type Output struct {
+	mu        sync.Mutex
+	w         io.Writer
+	format    string
+	showreply bool     // Displays the contents of the reply packet
+	intervals int      // Interval stats written in text format
+	recent    []*Event // Ring of the recent events
+	next      int      // Position of the next event in ring
+}
+
+// NewOutput new output
+func NewOutput(c *Conf) (*Output, error) {
+	switch c.Format {
+	case "":
+		c.Format = TextFormat
+	case TextFormat, JSONFormat, LogfmtFormat:
+	default:
+		return nil, fmt.Errorf("Not support output format %s", c.Format)
+	}
+
+	// The terminal ui takes over the screen
+	w := c.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+	if c.TUI {
+		w = ioutil.Discard
+	}
+
+	return &Output{
+		w:         w,
+		format:    c.Format,
+		showreply: c.ShowReply,
+	}, nil
+}
+
+// NewEvent build the event of request and its reply, with the server processing time
+// and the network round trip time which is 0 if unknown
+func NewEvent(protocol string, req, rsp *p.Packet, process, rtt time.Duration) *Event {
+	cost := rsp.Timestap.Sub(req.Timestap)
+	return &Event{
+		Time:     req.Timestap,
+		Client:   req.SrcID,
+		Server:   req.DstID,
+		Protocol: protocol,
+		Command:  req.Command,
+		Latency:  cost.Microseconds(),
+		Process:  process.Microseconds(),
+		RTT:      rtt.Microseconds(),
+		ReqSize:  req.PayloadLen,
+		RspSize:  rsp.PayloadLen,
+		Status:   rsp.Status,
+		Error:    rsp.Error,
+		Rows:     rsp.Rows,
+		User:     req.User,
+		Database: req.Database,
+		Request:  req.Content,
+		Response: rsp.Content,
+		cost:     cost,
+		process:  process,
+		rtt:      rtt,
+	}
+}
+
+// annotate describe the request in the comments of saved packets
+func annotate(v *p.Packet) string {
+	s := v.Content
+	if s == "" {
+		s = v.Command
+	}
+	if len(s) > AnnotateSize {
+		s = s[:AnnotateSize] + "..."
+	}
+
+	return strconv.Quote(s)
+}
+
+// Write write the event
+func (o *Output) Write(e *Event) {
+	if !o.showreply && e.Response != "" {
+		ev := *e
+		ev.Response = ""
+		e = &ev
+	}
+
+	var line string
+	switch o.format {
+	case JSONFormat:
+		b, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		line = string(b)
+	case LogfmtFormat:
+		line = e.Logfmt()
+	default:
+		cost := fmt.Sprintf("%v", e.cost)
+		if e.rtt > 0 {
+			cost += fmt.Sprintf(" (server %v, rtt %v)", e.process, e.rtt)
+		}
+		line = fmt.Sprintf("%v | %s -> %s | %v | %v",
+			e.Time.Format("2006-01-02 15:04:05"), e.Client, e.Server, cost, e.Request)
+		if o.showreply {
+			line += fmt.Sprintf(" | %v", e.Response)
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.recent) < RecentEvents {
+		o.recent = append(o.recent, e)
+	} else {
+		o.recent[o.next] = e
+	}
+	o.next = (o.next + 1) % RecentEvents
+	fmt.Fprintln(o.w, line)
+}
+
+// Recent recent events from the newest to the oldest
+func (o *Output) Recent() []*Event {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var events []*Event
+	for i := 1; i <= len(o.recent); i++ {
+		events = append(events, o.recent[(o.next-i+RecentEvents)%RecentEvents])
+	}
+
+	return events
+}
+
+// WriteInterval write the interval stats, the text format prints a header periodically like iostat
+func (o *Output) WriteInterval(r *IntervalStats) {
+	var line string
+	switch o.format {
+	case JSONFormat:
+		b, err := json.Marshal(r)
+		if err != nil {
+			return
+		}
+		line = string(b)
+	case LogfmtFormat:
+		line = strings.Join([]string{
+			"type=" + r.Type,
+			"time=" + r.Time.Format(time.RFC3339Nano),
+			"interval_s=" + strconv.FormatFloat(r.Interval, 'f', -1, 64),
+			"qps=" + strconv.FormatFloat(r.QPS, 'f', 1, 64),
+			"requests=" + strconv.FormatInt(r.Request, 10),
+			"responses=" + strconv.FormatInt(r.Response, 10),
+			"slow=" + strconv.FormatInt(r.Slow, 10),
+			"errors=" + strconv.FormatInt(r.Errors, 10),
+			"error_rate=" + strconv.FormatFloat(r.ErrorRate, 'f', 4, 64),
+			"p50_us=" + strconv.FormatInt(r.P50, 10),
+			"p99_us=" + strconv.FormatInt(r.P99, 10),
+			"max_us=" + strconv.FormatInt(r.Max, 10),
+		}, " ")
+	default:
+		line = fmt.Sprintf("%-19s %10.1f %10d %10d %8d %8.2f%% %10d %10d %10d",
+			r.Time.Format("2006-01-02 15:04:05"), r.QPS, r.Request, r.Response, r.Slow, r.ErrorRate*100, r.P50, r.P99, r.Max)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.format == TextFormat {
+		if o.intervals%IntervalHeaderLines == 0 {
+			fmt.Fprintf(o.w, "%-19s %10s %10s %10s %8s %9s %10s %10s %10s\n",
+				"time", "qps", "requests", "responses", "slow", "error", "p50(us)", "p99(us)", "max(us)")
+		}
+		o.intervals++
+	}
+	fmt.Fprintln(o.w, line)
+}
+
+// WriteError write the error met while capturing, which is not fatal
+func (o *Output) WriteError(e error) {
+	var line string
+	switch o.format {
+	case JSONFormat:
+		b, err := json.Marshal(map[string]string{"type": "error", "error": e.Error()})
+		if err != nil {
+			return
+		}
+		line = string(b)
+	case LogfmtFormat:
+		line = "type=error error=" + quote(e.Error())
+	default:
+		line = e.Error()
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fmt.Fprintln(o.w, line)
+}
+
+// Logfmt format the event as logfmt
+func (e *Event) Logfmt() string {
+	kvs := []string{
+		"time=" + e.Time.Format(time.RFC3339Nano),
+		"client=" + quote(e.Client),
+		"server=" + quote(e.Server),
+		"protocol=" + quote(e.Protocol),
+		"command=" + quote(e.Command),
+		"latency_us=" + strconv.FormatInt(e.Latency, 10),
+		"process_us=" + strconv.FormatInt(e.Process, 10),
+		"request_size=" + strconv.Itoa(e.ReqSize),
+		"response_size=" + strconv.Itoa(e.RspSize),
+		"status=" + quote(e.Status),
+		"error=" + strconv.FormatBool(e.Error),
+	}
+	if e.RTT != 0 {
+		kvs = append(kvs, "rtt_us="+strconv.FormatInt(e.RTT, 10))
+	}
+	if e.Rows != 0 {
+		kvs = append(kvs, "rows="+strconv.FormatInt(e.Rows, 10))
+	}
+	if e.User != "" {
+		kvs = append(kvs, "user="+quote(e.User))
+	}
+	if e.Database != "" {
+		kvs = append(kvs, "database="+quote(e.Database))
+	}
+	kvs = append(kvs, "request="+quote(e.Request))
+	if e.Response != "" {
+		kvs = append(kvs, "response="+quote(e.Response))
+	}
+
+	return strings.Join(kvs, " ")
+}
+
+// quote quote the logfmt value when necessary
+func quote(v string) string {
+	if v == "" {
+		return `""`
+	}
+	for _, c := range v {
+		if c <= ' ' || c == '=' || c == '"' || c == '\\' || c > '~' {
+			return strconv.Quote(v)
+		}
+	}
+
+	return v
+}
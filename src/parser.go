@@ -1,10 +1,13 @@
 package src
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"strings"
 
 	p "github.com/bugwz/hamburg/parser"
+	u "github.com/bugwz/hamburg/utils"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	lua "github.com/yuin/gopher-lua"
@@ -32,8 +35,9 @@ func NewParser(c *Conf) (*Parser, error) {
 	var l *Lua = nil
 	if c.Script != "" {
 		lstate := lua.NewState()
-		if lstate.DoFile(c.Script) != nil {
+		if e := lstate.DoFile(c.Script); e != nil {
 			lstate.Close()
+			return nil, fmt.Errorf("Load lua script %s failed: %v", c.Script, e)
 		}
 		l = &Lua{
 			state: lstate,
@@ -52,11 +56,41 @@ func (s *Parser) Run(v *p.Packet) {
 	s.x.Run(v)
 }
 
+// Splitter splitter of the protocol, nil if the protocol can not frame messages
+func (s *Parser) Splitter() p.Splitter {
+	sp, _ := s.x.(p.Splitter)
+	return sp
+}
+
+// Close release the state kept by parser for the closed connection
+func (s *Parser) Close(v *p.Packet) {
+	if c, ok := s.x.(p.Closer); ok {
+		c.Close(v)
+	}
+}
+
+// Reset drop the framing state kept by parser for the stream which lost its framing
+func (s *Parser) Reset(v *p.Packet) {
+	if r, ok := s.x.(p.Resetter); ok {
+		r.Reset(v)
+	}
+}
+
+// CloseScript close the lua state of custom script
+func (s *Parser) CloseScript() {
+	if s.lua != nil {
+		s.lua.state.Close()
+	}
+}
+
+// ErrNoScript the custom script is not loaded
+var ErrNoScript = errors.New("lua script is not available")
+
 // RunScript run custom script
 func (s *Parser) RunScript(pkt *p.Packet) error {
 	l := s.lua
 	if l == nil {
-		return fmt.Errorf("lua script is not available")
+		return ErrNoScript
 	}
 
 	l.args.RawSetString("type", lua.LString(fmt.Sprintf("[%s]", pkt.Type)))
@@ -77,7 +111,6 @@ func (s *Parser) RunScript(pkt *p.Packet) error {
 		NRet:    1,
 		Protect: true,
 	}, l.args); err != nil {
-		fmt.Printf("run lua script failed: %v", err)
 		return fmt.Errorf("run lua script failed: %v", err)
 	}
 
@@ -89,20 +122,23 @@ func (s *Parser) UnpackLayers(gop *gopacket.Packet) *p.Packet {
 	pkt := &p.Packet{Type: s.GetLayers(*gop)}
 	pkt.Timestap = (*gop).Metadata().CaptureInfo.Timestamp
 
-	// Ethernet layer
+	// Ethernet layer, or the cooked header of loopback and "any" interface
 	if ethernet := s.ParseEthernetLayer(*gop); ethernet != nil {
 		pkt.SrcMAC = ethernet.SrcMAC.String()
 		pkt.DstMAC = ethernet.DstMAC.String()
+	} else if addr := s.ParseCookedLayer(*gop); addr != nil {
+		pkt.SrcMAC = addr.String()
 	}
 
 	// IP layer
-	if ip := s.ParseIPLayer(*gop); ip != nil {
-		pkt.SrcIP = fmt.Sprintf("%s", ip.SrcIP)
-		pkt.DstIP = fmt.Sprintf("%s", ip.DstIP)
+	if src, dst := s.ParseIPLayer(*gop); src != nil && dst != nil {
+		pkt.SrcIP = src.String()
+		pkt.DstIP = dst.String()
 	}
 
 	// UDP layer
 	if udp := s.ParseUDPLayer(*gop); udp != nil {
+		pkt.Transport = UDP
 		pkt.SrcPort = fmt.Sprintf("%d", udp.SrcPort)
 		pkt.DstPort = fmt.Sprintf("%d", udp.DstPort)
 		pkt.CheckSum = fmt.Sprintf("%d", udp.Checksum)
@@ -112,6 +148,7 @@ func (s *Parser) UnpackLayers(gop *gopacket.Packet) *p.Packet {
 
 	// TCP layer
 	if tcp := s.ParseTCPLayer(*gop); tcp != nil {
+		pkt.Transport = TCP
 		pkt.SrcPort = fmt.Sprintf("%d", tcp.SrcPort)
 		pkt.DstPort = fmt.Sprintf("%d", tcp.DstPort)
 		pkt.CheckSum = fmt.Sprintf("%d", tcp.Checksum)
@@ -156,8 +193,8 @@ func (s *Parser) UnpackLayers(gop *gopacket.Packet) *p.Packet {
 		pkt.FlagStr = strings.Join(fstr, ",")
 		pkt.ACK = fmt.Sprintf("%d", tcp.Ack)
 	}
-	pkt.SrcID = fmt.Sprintf("%s:%s", pkt.SrcIP, pkt.SrcPort)
-	pkt.DstID = fmt.Sprintf("%s:%s", pkt.DstIP, pkt.DstPort)
+	pkt.SrcID = net.JoinHostPort(pkt.SrcIP, pkt.SrcPort)
+	pkt.DstID = net.JoinHostPort(pkt.DstIP, pkt.DstPort)
 
 	// Find payload
 	if app := (*gop).ApplicationLayer(); app != nil {
@@ -183,46 +220,74 @@ func (s *Parser) GetLayers(pkt gopacket.Packet) string {
 	return strings.Join(pkts, "/")
 }
 
-// ParseEthernetLayer ethernet layer
+// InnerLayers the innermost network layer and the transport layer carried by it, so
+// that the flows tunneled by VXLAN, GRE or IP in IP are analyzed instead of the tunnels
+func InnerLayers(pkt gopacket.Packet) (gopacket.Layer, gopacket.Layer) {
+	var network, transport gopacket.Layer
+	for _, l := range pkt.Layers() {
+		switch l.LayerType() {
+		case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+			network, transport = l, nil
+		case layers.LayerTypeTCP, layers.LayerTypeUDP:
+			if network != nil {
+				transport = l
+			}
+		}
+	}
+
+	return network, transport
+}
+
+// ParseEthernetLayer the innermost ethernet layer
 func (s *Parser) ParseEthernetLayer(pkt gopacket.Packet) *layers.Ethernet {
-	ethernetLayer := pkt.Layer(layers.LayerTypeEthernet)
-	if ethernetLayer != nil {
-		ethernetPacket, _ := ethernetLayer.(*layers.Ethernet)
-		return ethernetPacket
+	var ethernet *layers.Ethernet
+	for _, l := range pkt.Layers() {
+		if v, ok := l.(*layers.Ethernet); ok {
+			ethernet = v
+		}
 	}
 
-	return nil
+	return ethernet
 }
 
-// ParseIPLayer ip layer
-func (s *Parser) ParseIPLayer(pkt gopacket.Packet) *layers.IPv4 {
-	ipLayer := pkt.Layer(layers.LayerTypeIPv4)
-	if ipLayer != nil {
-		ip, _ := ipLayer.(*layers.IPv4)
-		return ip
+// ParseCookedLayer the sender address of linux cooked capture, which has no ethernet layer
+func (s *Parser) ParseCookedLayer(pkt gopacket.Packet) net.HardwareAddr {
+	switch l := pkt.LinkLayer().(type) {
+	case *layers.LinuxSLL:
+		return l.Addr
+	case *u.LinuxSLL2:
+		return l.Addr
 	}
 
 	return nil
 }
 
-// ParseTCPLayer tcp layer
-func (s *Parser) ParseTCPLayer(pkt gopacket.Packet) *layers.TCP {
-	tcpLayer := pkt.Layer(layers.LayerTypeTCP)
-	if tcpLayer != nil {
-		tcp, _ := tcpLayer.(*layers.TCP)
-		return tcp
+// ParseIPLayer the innermost ip layer, return the source and destination of IPv4 or IPv6
+func (s *Parser) ParseIPLayer(pkt gopacket.Packet) (net.IP, net.IP) {
+	// The extension headers are decoded as separate layers behind IPv6
+	network, _ := InnerLayers(pkt)
+	switch ip := network.(type) {
+	case *layers.IPv4:
+		return ip.SrcIP, ip.DstIP
+	case *layers.IPv6:
+		return ip.SrcIP, ip.DstIP
 	}
 
-	return nil
+	return nil, nil
 }
 
-// ParseUDPLayer udp layer
+// ParseTCPLayer the tcp layer of the innermost flow
+func (s *Parser) ParseTCPLayer(pkt gopacket.Packet) *layers.TCP {
+	_, transport := InnerLayers(pkt)
+	tcp, _ := transport.(*layers.TCP)
+
+	return tcp
+}
+
+// ParseUDPLayer the udp layer of the innermost flow
 func (s *Parser) ParseUDPLayer(pkt gopacket.Packet) *layers.UDP {
-	tcpLayer := pkt.Layer(layers.LayerTypeUDP)
-	if tcpLayer != nil {
-		udp, _ := tcpLayer.(*layers.UDP)
-		return udp
-	}
+	_, transport := InnerLayers(pkt)
+	udp, _ := transport.(*layers.UDP)
 
-	return nil
+	return udp
 }
@@ -0,0 +1,110 @@
+package src
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	p "github.com/bugwz/hamburg/parser"
+)
+
+// Placeholders of the path segments replaced automatically
+const (
+	RouteID   = "{id}"
+	RouteUUID = "{uuid}"
+	RouteHex  = "{hex}"
+)
+
+var (
+	routeNumber = regexp.MustCompile(`^[0-9]+$`)
+	routeUUID   = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	routeHex    = regexp.MustCompile(`^[0-9a-fA-F]{8,}$`)
+)
+
+// Router normalize the url paths into routes, so that the requests of the same
+// endpoint with different ids are aggregated together
+type Router struct {
+	patterns [][]string // Segments of the user patterns in order
+}
+
+// NewRouter new router with the patterns splited with commas, such as "/users/{id}",
+// where "{name}" matches any segment and the trailing "*" matches the rest of path
+func NewRouter(patterns string) (*Router, error) {
+	r := &Router{}
+	for _, v := range strings.Split(patterns, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.HasPrefix(v, "/") {
+			return nil, fmt.Errorf("Route pattern %s should start with /", v)
+		}
+		segs := strings.Split(v, "/")
+		for i, seg := range segs {
+			if seg == "*" && i != len(segs)-1 {
+				return nil, fmt.Errorf("Route pattern %s has * before the last segment", v)
+			}
+		}
+		r.patterns = append(r.patterns, segs)
+	}
+
+	return r, nil
+}
+
+// Normalize return the first pattern matched by the path, otherwise the path
+// with the numeric, uuid and hex segments replaced by placeholders
+func (r *Router) Normalize(path string) string {
+	segs := strings.Split(path, "/")
+	for _, pattern := range r.patterns {
+		if routeMatch(pattern, segs) {
+			return strings.Join(pattern, "/")
+		}
+	}
+
+	for i, seg := range segs {
+		switch {
+		case routeNumber.MatchString(seg):
+			segs[i] = RouteID
+		case routeUUID.MatchString(seg):
+			segs[i] = RouteUUID
+		case routeHex.MatchString(seg) && strings.ContainsAny(seg, "0123456789"):
+			segs[i] = RouteHex
+		}
+	}
+
+	return strings.Join(segs, "/")
+}
+
+// routeMatch whether the segments of path match the pattern
+func routeMatch(pattern, segs []string) bool {
+	for i, seg := range pattern {
+		if seg == "*" {
+			return true
+		}
+		if i >= len(segs) {
+			return false
+		}
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if segs[i] == "" {
+				return false
+			}
+			continue
+		}
+		if seg != segs[i] {
+			return false
+		}
+	}
+
+	return len(pattern) == len(segs)
+}
+
+// Route normalize the path in the command of http request before it is aggregated,
+// the grpc methods are kept as they are
+func (s *State) Route(v *p.Packet) {
+	if s.router == nil || s.protocol != p.HTTP && s.protocol != p.HTTP2 && s.protocol != p.GRPC {
+		return
+	}
+	if i := strings.IndexByte(v.Command, ' '); i >= 0 {
+		v.Command = v.Command[:i+1] + s.router.Normalize(v.Command[i+1:])
+	}
+}
@@ -0,0 +1,141 @@
+package src
+
+import (
+	"strconv"
+	"time"
+
+	p "github.com/bugwz/hamburg/parser"
+)
+
+/* Network round trip time seen from the capture point
+
+client            capture             server
+  |  SYN  ----------> t1 ---------------> |
+  |                                       |  server leg = t2 - t1
+  | <---------------- t2 <------- SYN/ACK |
+  |  ACK  ----------> t3                  |  client leg = t3 - t2
+
+The latency between request and reply captured includes the server leg, and the
+client leg is added when the client sees the reply, so the server processing time
+is latency - server leg and the network round trip time is server leg + client leg.
+The pure ACKs of the data segments sample the legs of the connections whose
+handshake was not captured, the minimum sample excludes the delayed ACKs.
+*/
+
+// Flight data segment waiting for the ACK of peer
+type Flight struct {
+	end uint32    // Sequence after the last byte
+	ts  time.Time // Capture time of the segment
+}
+
+// Timing round trip time of one tcp connection
+type Timing struct {
+	syn    time.Time     // Capture time of SYN
+	synack time.Time     // Capture time of SYN/ACK, reset after the handshake is done
+	server time.Duration // Round trip time between the capture point and server
+	client time.Duration // Round trip time between the capture point and client
+	flight [2]*Flight    // Unacknowledged data of the client and server
+}
+
+// RTT estimate the round trip time of tcp connections
+type RTT struct {
+	conns map[string]*Timing // Connections indexed by "client -> server"
+}
+
+// NewRTT new rtt
+func NewRTT() *RTT {
+	return &RTT{
+		conns: make(map[string]*Timing),
+	}
+}
+
+// Observe sample the round trip time by the tcp handshake and pure ACKs
+func (r *RTT) Observe(v *p.Packet) {
+	if v.Transport != TCP {
+		return
+	}
+
+	id := p.ConnID(v)
+	t := r.conns[id]
+	if t == nil {
+		t = &Timing{}
+		r.conns[id] = t
+	}
+
+	switch {
+	case v.Flag&SYN != 0 && v.Flag&ACK == 0:
+		*t = Timing{syn: v.Timestap}
+		return
+	case v.Flag&SYN != 0:
+		if !t.syn.IsZero() {
+			t.server = sample(t.server, v.Timestap.Sub(t.syn))
+			t.synack = v.Timestap
+		}
+		return
+	case v.Request && !t.synack.IsZero():
+		t.client = sample(t.client, v.Timestap.Sub(t.synack))
+		t.synack = time.Time{}
+	}
+
+	// Index 0 is the data of client and 1 is the data of server
+	self, peer := 0, 1
+	if !v.Request {
+		self, peer = 1, 0
+	}
+
+	// Keep the earliest unacknowledged segment, PayloadLen of the packet is the length of frame
+	if v.Payload != "" && t.flight[self] == nil {
+		seq, _ := strconv.ParseUint(v.Sequence, 10, 32)
+		t.flight[self] = &Flight{end: uint32(seq) + uint32(len(v.Payload)), ts: v.Timestap}
+	}
+
+	f := t.flight[peer]
+	ack, _ := strconv.ParseUint(v.ACK, 10, 32)
+	if f == nil || v.Flag&ACK == 0 || seqDiff(uint32(ack), f.end) < 0 {
+		return
+	}
+	t.flight[peer] = nil
+
+	// The ACKs piggybacked on data are delayed by the application
+	if v.Payload != "" {
+		return
+	}
+	if v.Request {
+		t.client = sample(t.client, v.Timestap.Sub(f.ts))
+	} else {
+		t.server = sample(t.server, v.Timestap.Sub(f.ts))
+	}
+}
+
+// Split split the latency of the connection into server processing time and network
+// round trip time, ok is false if the round trip time is not sampled yet
+func (r *RTT) Split(id string, latency time.Duration) (process, rtt time.Duration, ok bool) {
+	t := r.conns[id]
+	if t == nil || t.server == 0 && t.client == 0 {
+		return latency, 0, false
+	}
+
+	process = latency - t.server
+	if process < 0 {
+		process = 0
+	}
+
+	return process, t.server + t.client, true
+}
+
+// Close release the timing of the closed connection
+func (r *RTT) Close(v *p.Packet) {
+	delete(r.conns, p.ConnID(v))
+}
+
+// sample keep the minimum positive sample
+func sample(old, t time.Duration) time.Duration {
+	if t <= 0 {
+		return old
+	}
+	if old == 0 || t < old {
+		return t
+	}
+
+	return old
+}
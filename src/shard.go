@@ -0,0 +1,104 @@
+package src
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	u "github.com/bugwz/hamburg/utils"
+)
+
+// Sharder hash the innermost flow of packets on the capture goroutine, only the link,
+// tunnel, network and transport headers are decoded and the rest is left to workers
+type Sharder struct {
+	linktype int
+	decoders map[gopacket.LayerType]gopacket.DecodingLayer
+}
+
+// NewSharder new sharder of the packets with the link type
+func NewSharder(linktype int) *Sharder {
+	s := &Sharder{linktype: linktype, decoders: make(map[gopacket.LayerType]gopacket.DecodingLayer)}
+	for _, d := range []gopacket.DecodingLayer{
+		&layers.Ethernet{}, &layers.Dot1Q{}, &layers.LinuxSLL{}, &u.LinuxSLL2{}, &layers.Loopback{},
+		&layers.GRE{}, &layers.VXLAN{}, &layers.IPv4{}, &layers.IPv6{}, &layers.TCP{}, &layers.UDP{},
+	} {
+		s.decoders[d.(gopacket.Layer).LayerType()] = d
+	}
+
+	return s
+}
+
+// first layer type of the packet data, LayerTypeZero if the link type is not decoded here
+func (s *Sharder) first(data []byte) gopacket.LayerType {
+	switch s.linktype {
+	case int(layers.LinkTypeEthernet):
+		return layers.LayerTypeEthernet
+	case int(layers.LinkTypeNull), int(layers.LinkTypeLoop):
+		return layers.LayerTypeLoopback
+	case int(layers.LinkTypeLinuxSLL):
+		return layers.LayerTypeLinuxSLL
+	case u.LinkTypeLinuxSLL2:
+		return u.LayerTypeLinuxSLL2
+	case u.LinkTypeIPv4:
+		return layers.LayerTypeIPv4
+	case u.LinkTypeIPv6:
+		return layers.LayerTypeIPv6
+	case u.LinkTypeRaw:
+		if len(data) > 0 && data[0]>>4 == 6 {
+			return layers.LayerTypeIPv6
+		}
+		return layers.LayerTypeIPv4
+	}
+
+	return gopacket.LayerTypeZero
+}
+
+// Hash the hash of the innermost flow, which is the same for both directions
+func (s *Sharder) Hash(pkt gopacket.Packet) uint64 {
+	data := pkt.Data()
+	typ := s.first(data)
+	if typ == gopacket.LayerTypeZero {
+		return s.decoded(pkt)
+	}
+
+	var network gopacket.NetworkLayer
+	var transport gopacket.TransportLayer
+	for len(data) > 0 {
+		d, ok := s.decoders[typ]
+		if !ok || d.DecodeFromBytes(data, gopacket.NilDecodeFeedback) != nil {
+			break
+		}
+		switch l := d.(type) {
+		case gopacket.NetworkLayer:
+			network, transport = l, nil
+		case gopacket.TransportLayer:
+			if network != nil {
+				transport = l
+			}
+		}
+		typ, data = d.NextLayerType(), d.LayerPayload()
+	}
+
+	var hash uint64
+	if network != nil {
+		hash = network.NetworkFlow().FastHash()
+	}
+	if transport != nil {
+		hash ^= transport.TransportFlow().FastHash()
+	}
+
+	return hash
+}
+
+// decoded the hash of the innermost flow from the fully decoded packet
+func (s *Sharder) decoded(pkt gopacket.Packet) uint64 {
+	var hash uint64
+	network, transport := InnerLayers(pkt)
+	if nl, ok := network.(gopacket.NetworkLayer); ok {
+		hash = nl.NetworkFlow().FastHash()
+	}
+	if tl, ok := transport.(gopacket.TransportLayer); ok {
+		hash ^= tl.TransportFlow().FastHash()
+	}
+
+	return hash
+}
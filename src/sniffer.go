@@ -5,8 +5,8 @@ import (
 	"time"
 
 	u "github.com/bugwz/hamburg/utils"
+	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/pcapgo"
 )
 
 // Protocol type
@@ -33,13 +33,19 @@ var noReplyCommands = []string{
 	"append", "prepend", "cas", "touch", "flushall",
 }
 
+// RingDumpGap minimum interval between two dumps of the ring buffer
+const RingDumpGap = 10 * time.Second
+
 // Sniffer sniffer
 type Sniffer struct {
 	ips       []string          // Filtering IPs in packets
 	ports     []string          // Filtering Ports in packets
 	localip   map[string]string // IP list obtained from local NIC
 	pktreader *pcap.Handle      // Packet source
-	pktwriter *pcapgo.Writer    // Save packet
+	pktwriter *u.PacketWriter   // Save packet
+	pktring   *u.PacketRing     // Latest packets dumped when slow requests are detected
+	pktmode   string            // Mode of saving packets into outfile
+	linktype  int               // Link type of the packet source
 	nic       *pcap.Interface   // Monitored NIC
 	duration  time.Duration     // Period of packet capture
 	promisc   bool              // NIC promiscuous mode
@@ -68,9 +74,12 @@ func NewSniffer(c *Conf) (*Sniffer, error) {
 		return nil, e
 	}
 
-	pktwriter, e := u.GetPacketWriter(c.Outfile, c.SnapLen)
-	if e != nil {
-		return nil, e
+	switch c.OutfileMode {
+	case "":
+		c.OutfileMode = SaveAll
+	case SaveAll, SaveSlow, SaveConn:
+	default:
+		return nil, fmt.Errorf("Not support outfile mode %s", c.OutfileMode)
 	}
 
 	filters, e := u.PacketFilter(c.FilterCustom, c.FilterPorts, c.FilterIPs)
@@ -81,12 +90,35 @@ func NewSniffer(c *Conf) (*Sniffer, error) {
 		return nil, fmt.Errorf("Set bpf filter faile: %v", e)
 	}
 
+	// The capture file records the real link type and filter of the source
+	linktype := u.GetLinkType(pktreader)
+	ring := c.Outfile != "" && c.RingSize > 0
+	src := u.PacketSource{
+		Name:     c.InterFile,
+		Filter:   filters,
+		LinkType: linktype,
+		SnapLen:  c.SnapLen,
+	}
+	pktwriter, e := u.GetPacketWriter(c.Outfile, src, c.OutfileSize<<20,
+		time.Duration(c.OutfileAge)*time.Second, c.OutfileCount, ring)
+	if e != nil {
+		return nil, e
+	}
+
+	var pktring *u.PacketRing
+	if ring {
+		pktring = u.NewPacketRing(c.RingSize<<20, RingDumpGap)
+	}
+
 	return &Sniffer{
 		ips:       ips,
 		ports:     ports,
 		localip:   localips,
 		pktreader: pktreader,
 		pktwriter: pktwriter,
+		pktring:   pktring,
+		pktmode:   c.OutfileMode,
+		linktype:  linktype,
 		nic:       u.GetNIC(c.InterFile),
 		duration:  time.Duration(c.Duration) * time.Second,
 	}, nil
@@ -107,6 +139,64 @@ func (s *Sniffer) GetDuration() time.Duration {
 	return s.duration
 }
 
+// SavePacket save the packet with comments into file or ring buffer, the packets are
+// saved by the keeper of workers instead if only the slow requests are wanted
+func (s *Sniffer) SavePacket(ci gopacket.CaptureInfo, data []byte, comments []string) error {
+	if s.pktring != nil {
+		if s.pktring.Add(ci, data, comments) {
+			return s.FlushRing()
+		}
+		return nil
+	}
+	if s.pktwriter != nil && s.pktmode == SaveAll {
+		s.pktwriter.WritePacket(ci, data, comments)
+	}
+
+	return nil
+}
+
+// NewKeeper new keeper of a worker if only the packets of slow requests are saved
+func (s *Sniffer) NewKeeper() *Keeper {
+	if s.pktwriter == nil || s.pktring != nil || s.pktmode == SaveAll {
+		return nil
+	}
+
+	return NewKeeper(s.pktmode, s.pktwriter)
+}
+
+// DumpRing dump the packets in ring buffer into a new file
+func (s *Sniffer) DumpRing() error {
+	if s.pktring == nil {
+		return nil
+	}
+
+	return s.pktring.Dump(s.pktwriter)
+}
+
+// FlushRing dump the packets of the postponed dump in ring buffer
+func (s *Sniffer) FlushRing() error {
+	if s.pktring == nil {
+		return nil
+	}
+
+	return s.pktring.Flush(s.pktwriter)
+}
+
+// Close flush the saved packets and close the capture handle
+func (s *Sniffer) Close() error {
+	s.pktreader.Close()
+	if s.pktring != nil {
+		if e := s.pktring.Flush(s.pktwriter); e != nil {
+			return e
+		}
+	}
+	if s.pktwriter != nil {
+		return s.pktwriter.Close()
+	}
+
+	return nil
+}
+
 // NICDetail nic detail
 func (s *Sniffer) NICDetail() {
 	if s.nic == nil {
@@ -3,24 +3,69 @@ package src
 import (
 	"fmt"
 	"math"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	p "github.com/bugwz/hamburg/parser"
+	"github.com/emirpasic/gods/lists/singlylinkedlist"
 	"github.com/emirpasic/gods/maps/hashmap"
 	"github.com/modood/table"
 )
 
+// MaxPendingRequests outstanding requests kept for each connection
+const MaxPendingRequests = 1024
+
+// MaxClients distinct client ips, the others are counted as OtherClient
+const MaxClients = 10000
+
+// OtherClient client of the requests beyond MaxClients
+const OtherClient = "OTHER"
+
+// MaxMetrics distinct (server, command) pairs, the others are counted as OtherCommand
+const MaxMetrics = 10000
+
+// OtherCommand command of the requests beyond MaxMetrics
+const OtherCommand = "OTHER"
+
 // State status summary
 type State struct {
-	request   int64             // Total request
-	response  int64             // Total response
-	slow      int64             // Total slow request/response
-	slowline  time.Duration     // Threshold for slow requests
-	cost      time.Duration     // Total cost
-	curmsg    string            // The latest packet content completed by the lifecycle
-	showreply bool              // Displays the contents of the reply packet
-	localip   map[string]string // IP list obtained from local NIC
-	bks       []*Buckets        // Time consuming interval of packet request reply
-	dict      *hashmap.Map      // A dictionary that records all request packets
+	mu       sync.Mutex         // Guard the stats read while capturing
+	protocol string             // Application layer protocol
+	request  int64              // Total request
+	response int64              // Total response
+	slow     int64              // Total slow request/response
+	errors   int64              // Total error response
+	slowline time.Duration      // Threshold for slow requests
+	topn     int                // Number of the slowest server and command pairs in summary
+	cost     time.Duration      // Total cost
+	process  time.Duration      // Total cost of server processing
+	rtt      time.Duration      // Total network round trip time of the pairs with rtt samples
+	rtts     int64              // Total request/response pair with rtt samples
+	localip  map[string]string  // IP list obtained from local NIC
+	bks      []*Buckets         // Time consuming interval of packet request reply
+	hist     *Histogram         // Latency histogram of packet request reply
+	interval *Interval          // Stats since the last interval report
+	dict     *hashmap.Map       // Outstanding requests of each connection in FIFO order
+	metrics  map[string]*Metric // Stats of each server endpoint and command
+	statuses map[string]*Metric // Stats of each server endpoint, command and status class of reply
+	clients  map[string]*Client // Stats of each client ip
+	router   *Router            // Normalize the url paths of http requests
+}
+
+// Metric stats of the requests with the same server endpoint and command
+type Metric struct {
+	server  string        // Server endpoint
+	command string        // Command or verb of the request
+	status  string        // Status class of the reply, empty if not broken down by status
+	request int64         // Total request
+	count   int64         // Total request/response pair
+	slow    int64         // Total slow request/response
+	errors  int64         // Total error response
+	cost    time.Duration // Total cost
+	bks     []int64       // Count in each interval of State.bks
+	hist    *Histogram    // Latency histogram
 }
 
 // StatPair stats table
@@ -29,6 +74,44 @@ type StatPair struct {
 	Value string // item value
 }
 
+// Client stats of the requests from the same client ip
+type Client struct {
+	ip      string        // Client ip
+	request int64         // Total request
+	count   int64         // Total request/response pair
+	slow    int64         // Total slow request/response
+	errors  int64         // Total error response
+	cost    time.Duration // Total cost
+}
+
+// CommandStat stats table of the server and command
+type CommandStat struct {
+	Server  string
+	Command string
+	Count   string
+	Error   string
+	Total   string
+	Avg     string
+	P50     string
+	P90     string
+	P99     string
+	P999    string
+	Max     string
+}
+
+// StatusStat stats table of the server, command and status class
+type StatusStat struct {
+	Server  string
+	Command string
+	Status  string
+	Count   string
+	Slow    string
+	Avg     string
+	P50     string
+	P99     string
+	Max     string
+}
+
 // Buckets time-consuming interval statistics block
 type Buckets struct {
 	k time.Duration // minimum time-consuming interval
@@ -47,15 +130,31 @@ func NewState(c *Conf) (*State, error) {
 		bks = append(bks, &Buckets{k: time.Duration(math.Pow10(i)*50) * time.Microsecond, v: 0})
 	}
 
+	router, e := NewRouter(c.Routes)
+	if e != nil {
+		return nil, e
+	}
+
 	return &State{
+		protocol: c.Protocol,
 		slowline: time.Duration(c.SlowThreshold) * time.Millisecond,
+		topn:     c.TopN,
 		bks:      bks,
+		hist:     NewHistogram(),
+		interval: NewInterval(),
 		dict:     hashmap.New(),
+		metrics:  make(map[string]*Metric),
+		statuses: make(map[string]*Metric),
+		clients:  make(map[string]*Client),
+		router:   router,
 	}, nil
 }
 
 // IncrReqRsp incr request and response
 func (s *State) IncrReqRsp(isreq bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if isreq {
 		s.request++
 	} else {
@@ -63,21 +162,264 @@ func (s *State) IncrReqRsp(isreq bool) {
 	}
 }
 
-// AddDuration incr time-consuming interval count
-func (s *State) AddDuration(t time.Duration) {
+// IncrCommand incr request count of the server and command
+func (s *State) IncrCommand(v *p.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metric(v.DstID, v.Command).request++
+	s.client(v.SrcIP).request++
+	s.interval.request++
+}
+
+// AddDuration incr time-consuming interval count of the request and the error count of its reply
+func (s *State) AddDuration(v, rsp *p.Packet, t time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.cost += t
+	c := s.client(v.SrcIP)
+	c.count++
+	c.cost += t
+	s.hist.Add(t)
+	s.interval.count++
+	s.interval.hist.Add(t)
+
+	slow := s.FitSlow(t)
+	if rsp.Error {
+		s.errors++
+		c.errors++
+		s.interval.errors++
+	}
 
-	if s.FitSlow(t) {
+	if slow {
 		s.slow++
+		c.slow++
+		s.interval.slow++
+	}
+
+	i := s.bucket(t)
+	s.bks[i].v++
+	s.metric(v.DstID, v.Command).add(t, i, slow, rsp.Error)
+	if rsp.Status != "" {
+		s.statusMetric(v.DstID, v.Command, StatusClass(rsp.Status)).add(t, i, slow, rsp.Error)
+	}
+}
+
+// add count the request/response pair which takes t in bucket i
+func (m *Metric) add(t time.Duration, i int, slow, err bool) {
+	m.count++
+	m.cost += t
+	m.hist.Add(t)
+	m.bks[i]++
+	if slow {
+		m.slow++
+	}
+	if err {
+		m.errors++
+	}
+}
+
+// merge add the stats of another metric
+func (m *Metric) merge(o *Metric) {
+	m.request += o.request
+	m.count += o.count
+	m.slow += o.slow
+	m.errors += o.errors
+	m.cost += o.cost
+	m.hist.Merge(o.hist)
+	for i := range m.bks {
+		m.bks[i] += o.bks[i]
+	}
+}
+
+// StatusClass class of the reply status, the http status codes are grouped as 2xx, 4xx
+// and so on, and the other statuses such as the error prefixes of redis are kept
+func StatusClass(status string) string {
+	if len(status) == 3 && strings.Trim(status, "0123456789") == "" {
+		return status[:1] + "xx"
 	}
 
+	return status
+}
+
+// AddNetwork add the server processing time and network round trip time of the request
+func (s *State) AddNetwork(process, rtt time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.process += process
+	if ok {
+		s.rtt += rtt
+		s.rtts++
+	}
+}
+
+// bucket index of the time-consuming interval
+func (s *State) bucket(t time.Duration) int {
 	buckets := s.bks
-	for i := len(buckets) - 1; i >= 0; i-- {
+	for i := len(buckets) - 1; i > 0; i-- {
 		if t >= buckets[i].k {
-			buckets[i].v++
-			return
+			return i
 		}
 	}
+
+	return 0
+}
+
+// metric find or create the stats of server and command
+func (s *State) metric(server, command string) *Metric {
+	key := fmt.Sprintf("%s %s", server, command)
+	if m, ok := s.metrics[key]; ok {
+		return m
+	}
+	if len(s.metrics) >= MaxMetrics && command != OtherCommand {
+		return s.metric(server, OtherCommand)
+	}
+
+	m := &Metric{
+		server:  server,
+		command: command,
+		bks:     make([]int64, len(s.bks)),
+		hist:    NewHistogram(),
+	}
+	s.metrics[key] = m
+
+	return m
+}
+
+// statusMetric find or create the stats of server endpoint, command and status class
+func (s *State) statusMetric(server, command, status string) *Metric {
+	key := fmt.Sprintf("%s %s %s", server, command, status)
+	if m, ok := s.statuses[key]; ok {
+		return m
+	}
+	if len(s.statuses) >= MaxMetrics && command != OtherCommand {
+		return s.statusMetric(server, OtherCommand, status)
+	}
+
+	m := &Metric{
+		server:  server,
+		command: command,
+		status:  status,
+		bks:     make([]int64, len(s.bks)),
+		hist:    NewHistogram(),
+	}
+	s.statuses[key] = m
+
+	return m
+}
+
+// client find or create the stats of client ip
+func (s *State) client(ip string) *Client {
+	if c, ok := s.clients[ip]; ok {
+		return c
+	}
+	if len(s.clients) >= MaxClients && ip != OtherClient {
+		return s.client(OtherClient)
+	}
+
+	c := &Client{ip: ip}
+	s.clients[ip] = c
+
+	return c
+}
+
+// PushRequest queue the request until its reply arrives
+func (s *State) PushRequest(id string, v *p.Packet) {
+	var q *singlylinkedlist.List
+	if old, exits := s.dict.Get(id); exits {
+		q = old.(*singlylinkedlist.List)
+	} else {
+		q = singlylinkedlist.New()
+		s.dict.Put(id, q)
+	}
+
+	// The replies of the oldest requests were lost
+	if q.Size() >= MaxPendingRequests {
+		q.Remove(0)
+	}
+	q.Add(v)
+}
+
+// PopRequest dequeue the outstanding request of the connection matched by the reply,
+// which is the request with the same match id or the oldest one
+func (s *State) PopRequest(id string, rsp *p.Packet) *p.Packet {
+	old, exits := s.dict.Get(id)
+	if !exits {
+		return nil
+	}
+
+	q := old.(*singlylinkedlist.List)
+	index := 0
+	if rsp.MatchID != "" {
+		index, _ = q.Find(func(_ int, v interface{}) bool {
+			return v.(*p.Packet).MatchID == rsp.MatchID
+		})
+	}
+	v, ok := q.Get(index)
+	if !ok {
+		return nil
+	}
+	q.Remove(index)
+	if q.Empty() {
+		s.dict.Remove(id)
+	}
+
+	return v.(*p.Packet)
+}
+
+// Oldest the time of the oldest outstanding request of the connection
+func (s *State) Oldest(id string) (time.Time, bool) {
+	if old, exits := s.dict.Get(id); exits {
+		if v, ok := old.(*singlylinkedlist.List).Get(0); ok {
+			return v.(*p.Packet).Timestap, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// DropRequests drop all outstanding requests of the connection
+func (s *State) DropRequests(id string) {
+	s.dict.Remove(id)
+}
+
+// Merge add the stats of another state
+func (s *State) Merge(o *State) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.request += o.request
+	s.response += o.response
+	s.slow += o.slow
+	s.errors += o.errors
+	s.cost += o.cost
+	s.process += o.process
+	s.rtt += o.rtt
+	s.rtts += o.rtts
+	for i := range s.bks {
+		s.bks[i].v += o.bks[i].v
+	}
+	s.hist.Merge(o.hist)
+
+	for _, om := range o.metrics {
+		s.metric(om.server, om.command).merge(om)
+	}
+	for _, om := range o.statuses {
+		s.statusMetric(om.server, om.command, om.status).merge(om)
+	}
+
+	for _, oc := range o.clients {
+		c := s.client(oc.ip)
+		c.request += oc.request
+		c.count += oc.count
+		c.slow += oc.slow
+		c.errors += oc.errors
+		c.cost += oc.cost
+	}
 }
 
 // FitSlow verify that the request is too slow
@@ -97,7 +439,14 @@ func (s *State) ShowStats() {
 	m = append(m, &StatPair{Item: "Request", Value: fmt.Sprintf("%d", s.request)})
 	m = append(m, &StatPair{Item: "Response", Value: fmt.Sprintf("%d", s.response)})
 	m = append(m, &StatPair{Item: "Slow", Value: fmt.Sprintf("%d", s.slow)})
+	m = append(m, &StatPair{Item: "Error", Value: fmt.Sprintf("%d", s.errors)})
 	m = append(m, &StatPair{Item: "Cost", Value: fmt.Sprintf("%v", s.cost)})
+	m = append(m, &StatPair{Item: "Server Cost", Value: fmt.Sprintf("%v", s.process)})
+	rtt := "-"
+	if s.rtts > 0 {
+		rtt = fmt.Sprintf("%v", s.rtt/time.Duration(s.rtts))
+	}
+	m = append(m, &StatPair{Item: "Network RTT (avg)", Value: rtt})
 	table.Output(m)
 
 	fmt.Println("Summary of time-consuming:")
@@ -113,4 +462,94 @@ func (s *State) ShowStats() {
 		Value: fmt.Sprintf("%d", bks[len(bks)-1].v),
 	})
 	table.Output(d)
+
+	var q []*StatPair
+	fmt.Println("Summary of percentiles:")
+	for _, v := range []float64{0.5, 0.9, 0.99, 0.999} {
+		q = append(q, &StatPair{
+			Item:  fmt.Sprintf("P%g", v*100),
+			Value: fmt.Sprintf("%v", s.hist.Quantile(v)),
+		})
+	}
+	q = append(q, &StatPair{Item: "Max", Value: fmt.Sprintf("%v", s.hist.Max)})
+	table.Output(q)
+
+	s.ShowCommands()
+	s.ShowStatuses()
+}
+
+// ShowCommands show the server and command pairs with the most total cost
+func (s *State) ShowCommands() {
+	var metrics []*Metric
+	for _, m := range s.metrics {
+		if m.count > 0 {
+			metrics = append(metrics, m)
+		}
+	}
+	if len(metrics) == 0 || s.topn <= 0 {
+		return
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].cost > metrics[j].cost
+	})
+	if len(metrics) > s.topn {
+		metrics = metrics[:s.topn]
+	}
+
+	var c []*CommandStat
+	for _, m := range metrics {
+		c = append(c, &CommandStat{
+			Server:  m.server,
+			Command: m.command,
+			Count:   fmt.Sprintf("%d", m.count),
+			Error:   fmt.Sprintf("%d", m.errors),
+			Total:   fmt.Sprintf("%v", m.cost),
+			Avg:     fmt.Sprintf("%v", m.cost/time.Duration(m.count)),
+			P50:     fmt.Sprintf("%v", m.hist.Quantile(0.5)),
+			P90:     fmt.Sprintf("%v", m.hist.Quantile(0.9)),
+			P99:     fmt.Sprintf("%v", m.hist.Quantile(0.99)),
+			P999:    fmt.Sprintf("%v", m.hist.Quantile(0.999)),
+			Max:     fmt.Sprintf("%v", m.hist.Max),
+		})
+	}
+
+	fmt.Printf("Top %d of the slowest commands:\n", len(c))
+	table.Output(c)
+}
+
+// ShowStatuses show the server, command and status class of replies with the most total cost
+func (s *State) ShowStatuses() {
+	var metrics []*Metric
+	for _, m := range s.statuses {
+		if m.count > 0 {
+			metrics = append(metrics, m)
+		}
+	}
+	if len(metrics) == 0 || s.topn <= 0 {
+		return
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].cost > metrics[j].cost
+	})
+	if len(metrics) > s.topn {
+		metrics = metrics[:s.topn]
+	}
+
+	var c []*StatusStat
+	for _, m := range metrics {
+		c = append(c, &StatusStat{
+			Server:  m.server,
+			Command: m.command,
+			Status:  m.status,
+			Count:   fmt.Sprintf("%d", m.count),
+			Slow:    fmt.Sprintf("%d", m.slow),
+			Avg:     fmt.Sprintf("%v", m.cost/time.Duration(m.count)),
+			P50:     fmt.Sprintf("%v", m.hist.Quantile(0.5)),
+			P99:     fmt.Sprintf("%v", m.hist.Quantile(0.99)),
+			Max:     fmt.Sprintf("%v", m.hist.Max),
+		})
+	}
+
+	fmt.Printf("Top %d of the slowest commands by status:\n", len(c))
+	table.Output(c)
 }
@@ -0,0 +1,286 @@
+package src
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	p "github.com/bugwz/hamburg/parser"
+)
+
+// Limits of tcp stream reassembly
+const (
+	MaxPendingSegments = 64      // Out-of-order segments kept before skipping the gap
+	MaxStreamBuffer    = 4 << 20 // Unframed bytes kept before dropping the stream buffer
+	MaxMessageHead     = 4 << 20 // Bytes of a message kept in its payload, the rest is only counted
+)
+
+// Segment out-of-order tcp segment waiting for the missing data
+type Segment struct {
+	seq  uint32    // Sequence of the first byte
+	data []byte    // Payload of the segment
+	ts   time.Time // Capture time of the segment
+}
+
+// Mark capture time of the bytes starting at the offset of stream buffer
+type Mark struct {
+	off int       // Offset in the stream buffer
+	ts  time.Time // Capture time of the segment
+}
+
+// Stream one direction of a tcp connection
+type Stream struct {
+	init    bool       // Whether the next sequence is known
+	next    uint32     // Next expected sequence
+	buf     []byte     // Contiguous data not yet framed into messages
+	marks   []*Mark    // Capture time of the data in buf
+	pending []*Segment // Out-of-order segments ordered by sequence
+	msg     *p.Packet  // Message whose parts are being received
+	head    []byte     // Head of the message kept in its payload
+	size    int        // Length of the message received so far
+	want    int        // Bytes of the current part not received yet
+	more    bool       // Whether the message continues after the current part
+}
+
+// Assembler reassemble tcp segments into contiguous streams
+type Assembler struct {
+	streams map[string]*Stream // Streams indexed by "src -> dst"
+}
+
+// NewAssembler new assembler
+func NewAssembler() *Assembler {
+	return &Assembler{
+		streams: make(map[string]*Stream),
+	}
+}
+
+// seqDiff signed distance between two sequences, handling wraparound
+func seqDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+// Reassemble feed the packet into its stream and return the complete messages, and
+// whether the framing of the stream was lost with the messages in flight
+func (a *Assembler) Reassemble(v *p.Packet, sp p.Splitter) ([]*p.Packet, bool) {
+	// UDP datagrams are complete messages
+	if v.Transport != TCP {
+		if v.Payload == "" {
+			return nil, false
+		}
+		return []*p.Packet{v}, false
+	}
+
+	id := fmt.Sprintf("%s -> %s", v.SrcID, v.DstID)
+	seq, _ := strconv.ParseUint(v.Sequence, 10, 32)
+
+	// Connection setup or teardown
+	if v.Flag&SYN != 0 {
+		a.streams[id] = &Stream{init: true, next: uint32(seq) + 1}
+		return nil, false
+	}
+	if v.Flag&RST != 0 {
+		delete(a.streams, id)
+		delete(a.streams, fmt.Sprintf("%s -> %s", v.DstID, v.SrcID))
+		return nil, false
+	}
+
+	s := a.streams[id]
+	if s == nil {
+		s = &Stream{}
+		a.streams[id] = s
+	}
+
+	var msgs []*p.Packet
+	lost := false
+	if v.Payload != "" {
+		lost = s.insert(uint32(seq), []byte(v.Payload), v.Timestap)
+		var broken bool
+		msgs, broken = s.split(v, sp)
+		lost = lost || broken
+	}
+
+	if v.Flag&FIN != 0 {
+		delete(a.streams, id)
+	}
+
+	return msgs, lost
+}
+
+// Close release both streams of the connection between client and server
+func (a *Assembler) Close(client, server string) {
+	delete(a.streams, fmt.Sprintf("%s -> %s", client, server))
+	delete(a.streams, fmt.Sprintf("%s -> %s", server, client))
+}
+
+// insert add the segment to the stream and move the contiguous data into buffer,
+// return whether the framing of buffer was lost
+func (s *Stream) insert(seq uint32, data []byte, ts time.Time) bool {
+	lost := false
+	// Capture started in the middle of the connection
+	if !s.init {
+		s.init = true
+		s.next = seq
+	}
+
+	// Retransmission or overlap with data already received
+	if d := seqDiff(s.next, seq); d > 0 {
+		if int(d) >= len(data) {
+			return false
+		}
+		data = data[d:]
+		seq = s.next
+	}
+
+	if seq != s.next {
+		s.queue(&Segment{seq: seq, data: data, ts: ts})
+		if len(s.pending) > MaxPendingSegments {
+			// Give up waiting for the lost data, which is only counted if it is inside
+			// the part being received, otherwise the framing of buffer is broken
+			if gap := int(seqDiff(s.pending[0].seq, s.next)); gap < s.want {
+				s.want -= gap
+				s.size += gap
+			} else {
+				s.reset()
+				lost = true
+			}
+			s.next = s.pending[0].seq
+		}
+	} else {
+		s.append(data, ts)
+	}
+
+	// Drain the out-of-order segments which became contiguous
+	for len(s.pending) > 0 {
+		seg := s.pending[0]
+		d := seqDiff(s.next, seg.seq)
+		if d < 0 {
+			break
+		}
+		s.pending = s.pending[1:]
+		if int(d) < len(seg.data) {
+			s.append(seg.data[d:], seg.ts)
+		}
+	}
+
+	return lost
+}
+
+// queue keep the out-of-order segment ordered by sequence
+func (s *Stream) queue(seg *Segment) {
+	i := 0
+	for ; i < len(s.pending); i++ {
+		d := seqDiff(seg.seq, s.pending[i].seq)
+		if d == 0 {
+			if len(seg.data) > len(s.pending[i].data) {
+				s.pending[i] = seg
+			}
+			return
+		}
+		if d < 0 {
+			break
+		}
+	}
+
+	s.pending = append(s.pending, nil)
+	copy(s.pending[i+1:], s.pending[i:])
+	s.pending[i] = seg
+}
+
+// append append contiguous data to the buffer
+func (s *Stream) append(data []byte, ts time.Time) {
+	s.marks = append(s.marks, &Mark{off: len(s.buf), ts: ts})
+	s.buf = append(s.buf, data...)
+	s.next += uint32(len(data))
+}
+
+// reset drop the data in buffer and the message being received
+func (s *Stream) reset() {
+	s.buf, s.marks = nil, nil
+	s.msg, s.head, s.size, s.want, s.more = nil, nil, 0, 0, false
+}
+
+// split cut the messages off the buffer part by part, return them once their last
+// parts are received, and whether the framing of buffer was lost. The long parts are
+// received as the data arrives, and only the head of message is kept in its payload
+func (s *Stream) split(v *p.Packet, sp p.Splitter) ([]*p.Packet, bool) {
+	var msgs []*p.Packet
+
+	for len(s.buf) > 0 {
+		if s.want == 0 {
+			// Without splitter every contiguous chunk is treated as a message
+			n, more := len(s.buf), false
+			if sp != nil {
+				n, more = sp.Split(v, s.buf)
+			}
+			if n < 0 || (n == 0 && len(s.buf) > MaxStreamBuffer) {
+				s.reset()
+				return msgs, true
+			}
+			if n == 0 {
+				break
+			}
+
+			// The whole message is already in buffer
+			if s.msg == nil && !more && n <= len(s.buf) {
+				msg := *v
+				msg.Payload = string(s.buf[:n])
+				msg.PayloadLen = n
+				msg.Timestap = s.marks[0].ts
+				msgs = append(msgs, &msg)
+				s.consume(n)
+				continue
+			}
+
+			if s.msg == nil {
+				msg := *v
+				msg.Timestap = s.marks[0].ts
+				s.msg = &msg
+			}
+			s.want, s.more = n, more
+		}
+
+		n := s.want
+		if n > len(s.buf) {
+			n = len(s.buf)
+		}
+		// The head stops growing at the limit or the lost data
+		if keep := MaxMessageHead - len(s.head); keep > 0 && len(s.head) == s.size {
+			if keep > n {
+				keep = n
+			}
+			s.head = append(s.head, s.buf[:keep]...)
+		}
+		s.size += n
+		s.want -= n
+		s.consume(n)
+		if s.want > 0 || s.more {
+			continue
+		}
+
+		s.msg.Payload = string(s.head)
+		s.msg.PayloadLen = s.size
+		msgs = append(msgs, s.msg)
+		s.msg, s.head, s.size = nil, nil, 0
+	}
+
+	return msgs, false
+}
+
+// consume drop the first n bytes of buffer
+func (s *Stream) consume(n int) {
+	s.buf = s.buf[n:]
+	if len(s.buf) == 0 {
+		s.buf, s.marks = nil, nil
+		return
+	}
+
+	i := 0
+	for i+1 < len(s.marks) && s.marks[i+1].off <= n {
+		i++
+	}
+	s.marks = s.marks[i:]
+	for _, m := range s.marks {
+		m.off -= n
+	}
+	s.marks[0].off = 0
+}
@@ -0,0 +1,9 @@
+package src
+
+import "golang.org/x/sys/unix"
+
+// Requests of terminal attributes
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+)
@@ -0,0 +1,52 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package src
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Terminal controlling terminal switched into raw mode
+type Terminal struct {
+	fd  int           // File descriptor of stdin
+	old *unix.Termios // Terminal attributes restored on exit
+}
+
+// OpenTerminal switch the terminal into raw mode to read the keys without echo
+func OpenTerminal() (*Terminal, error) {
+	fd := int(os.Stdin.Fd())
+	old, e := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if e != nil {
+		return nil, fmt.Errorf("Stdin is not a terminal: %v", e)
+	}
+
+	// Keep ISIG so that Ctrl-C still works
+	raw := *old
+	raw.Lflag &^= unix.ECHO | unix.ICANON
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if e := unix.IoctlSetTermios(fd, ioctlSetTermios, &raw); e != nil {
+		return nil, fmt.Errorf("Set terminal raw mode failed: %v", e)
+	}
+
+	return &Terminal{fd: fd, old: old}, nil
+}
+
+// Size columns and rows of the terminal
+func (t *Terminal) Size() (int, int) {
+	ws, e := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+	if e != nil || ws.Col == 0 || ws.Row == 0 {
+		return 80, 24
+	}
+
+	return int(ws.Col), int(ws.Row)
+}
+
+// Restore restore the terminal attributes
+func (t *Terminal) Restore() {
+	unix.IoctlSetTermios(t.fd, ioctlSetTermios, t.old)
+}
@@ -0,0 +1,60 @@
+package src
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// Terminal console switched into raw mode
+type Terminal struct {
+	in      windows.Handle // Console input
+	out     windows.Handle // Console output
+	inmode  uint32         // Input mode restored on exit
+	outmode uint32         // Output mode restored on exit
+}
+
+// OpenTerminal switch the console into raw mode to read the keys without echo,
+// and enable the ANSI escape sequences
+func OpenTerminal() (*Terminal, error) {
+	t := &Terminal{}
+	var e error
+	if t.in, e = windows.GetStdHandle(windows.STD_INPUT_HANDLE); e != nil {
+		return nil, e
+	}
+	if t.out, e = windows.GetStdHandle(windows.STD_OUTPUT_HANDLE); e != nil {
+		return nil, e
+	}
+	if e = windows.GetConsoleMode(t.in, &t.inmode); e != nil {
+		return nil, fmt.Errorf("Stdin is not a console: %v", e)
+	}
+	if e = windows.GetConsoleMode(t.out, &t.outmode); e != nil {
+		return nil, fmt.Errorf("Stdout is not a console: %v", e)
+	}
+
+	if e = windows.SetConsoleMode(t.in, t.inmode&^(windows.ENABLE_LINE_INPUT|windows.ENABLE_ECHO_INPUT)); e != nil {
+		return nil, fmt.Errorf("Set console raw mode failed: %v", e)
+	}
+	if e = windows.SetConsoleMode(t.out, t.outmode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); e != nil {
+		t.Restore()
+		return nil, fmt.Errorf("Enable console escape sequences failed: %v", e)
+	}
+
+	return t, nil
+}
+
+// Size columns and rows of the console window
+func (t *Terminal) Size() (int, int) {
+	var info windows.ConsoleScreenBufferInfo
+	if e := windows.GetConsoleScreenBufferInfo(t.out, &info); e != nil {
+		return 80, 24
+	}
+
+	return int(info.Window.Right-info.Window.Left) + 1, int(info.Window.Bottom-info.Window.Top) + 1
+}
+
+// Restore restore the console modes
+func (t *Terminal) Restore() {
+	windows.SetConsoleMode(t.in, t.inmode)
+	windows.SetConsoleMode(t.out, t.outmode)
+}
@@ -0,0 +1,89 @@
+package src
+
+import (
+	"time"
+
+	p "github.com/bugwz/hamburg/parser"
+)
+
+// Limits of the connections tracked by a worker
+const (
+	ConnIdleTimeout   = 5 * time.Minute  // Connections without packets for the timeout are released
+	ConnSweepInterval = 30 * time.Second // Interval of looking for the idle connections
+)
+
+// Tracked connection tracked by a worker
+type Tracked struct {
+	client string    // Id of client
+	server string    // Id of server
+	fins   [2]bool   // Whether the FIN of client and server was seen
+	last   time.Time // Capture time of the latest packet
+}
+
+// Packet pseudo request packet of the connection, which is used to release the state
+// indexed by "client -> server"
+func (c *Tracked) Packet() *p.Packet {
+	return &p.Packet{Request: true, SrcID: c.client, DstID: c.server}
+}
+
+// Tracker track the connections of a worker until both sides are closed, the
+// connection is reset, or it is idle such as the udp flows and the lost FINs
+type Tracker struct {
+	conns map[string]*Tracked // Connections indexed by "client -> server"
+	sweep time.Time           // Capture time of the last sweep
+}
+
+// NewTracker new tracker
+func NewTracker() *Tracker {
+	return &Tracker{
+		conns: make(map[string]*Tracked),
+	}
+}
+
+// Observe update the connection of the packet, return the connections to be released
+func (t *Tracker) Observe(v *p.Packet) []*Tracked {
+	var done []*Tracked
+
+	id := p.ConnID(v)
+	c := t.conns[id]
+	if c == nil {
+		c = &Tracked{client: v.SrcID, server: v.DstID}
+		if !v.Request {
+			c.client, c.server = v.DstID, v.SrcID
+		}
+		t.conns[id] = c
+	}
+	c.last = v.Timestap
+
+	// Index 0 is the client and 1 is the server
+	side := 0
+	if !v.Request {
+		side = 1
+	}
+	switch {
+	case v.Flag&RST != 0:
+		done = append(done, c)
+		delete(t.conns, id)
+	case v.Flag&SYN != 0:
+		c.fins = [2]bool{}
+	case v.Flag&FIN != 0:
+		c.fins[side] = true
+		if c.fins[0] && c.fins[1] {
+			done = append(done, c)
+			delete(t.conns, id)
+		}
+	}
+
+	if v.Timestap.Sub(t.sweep) < ConnSweepInterval {
+		return done
+	}
+	t.sweep = v.Timestap
+	for k, o := range t.conns {
+		if v.Timestap.Sub(o.last) >= ConnIdleTimeout {
+			done = append(done, o)
+			delete(t.conns, k)
+		}
+	}
+
+	return done
+}
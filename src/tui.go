@@ -0,0 +1,273 @@
+package src
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TUIRefresh refresh interval of the terminal ui
+const TUIRefresh = time.Second
+
+// ANSI escape sequences of the terminal ui
+const (
+	ansiAltScreen  = "\x1b[?1049h\x1b[?25l"
+	ansiMainScreen = "\x1b[?25h\x1b[?1049l"
+	ansiHome       = "\x1b[H"
+	ansiClearLine  = "\x1b[K"
+	ansiClearDown  = "\x1b[J"
+	ansiReverse    = "\x1b[7m"
+	ansiBold       = "\x1b[1m"
+	ansiReset      = "\x1b[0m"
+)
+
+// TUISorts sort keys of the command table
+var TUISorts = map[byte]string{
+	't': "total",
+	'c': "count",
+	'a': "avg",
+	'p': "p99",
+	'm': "max",
+	'e': "errors",
+}
+
+// TUI live terminal ui like top
+type TUI struct {
+	h        *Hamburg
+	term     *Terminal
+	sort     byte      // Sort key of the command table
+	start    time.Time // Start time of the ui
+	last     time.Time // Time of the last refresh
+	requests int64     // Total requests at the last refresh
+	qps      float64   // Requests per second since the last refresh
+	keys     chan byte // Keys pressed
+	done     chan bool // Closed when the ui is stopped
+}
+
+// NewTUI new terminal ui
+func NewTUI(h *Hamburg) (*TUI, error) {
+	term, e := OpenTerminal()
+	if e != nil {
+		return nil, e
+	}
+
+	return &TUI{
+		h:     h,
+		term:  term,
+		sort:  't',
+		start: time.Now(),
+		last:  time.Now(),
+		keys:  make(chan byte),
+		done:  make(chan bool),
+	}, nil
+}
+
+// Run refresh the screen until quit
+func (t *TUI) Run() {
+	fmt.Print(ansiAltScreen)
+	go t.readKeys()
+
+	ticker := time.NewTicker(TUIRefresh)
+	defer ticker.Stop()
+	t.draw(time.Now())
+	for {
+		select {
+		case <-t.done:
+			return
+		case k := <-t.keys:
+			if k == 'q' || k == 'Q' {
+				t.h.Exit(SignalExit)
+				return
+			}
+			if _, ok := TUISorts[k]; ok {
+				t.sort = k
+			}
+			t.draw(time.Now())
+		case now := <-ticker.C:
+			t.draw(now)
+		}
+	}
+}
+
+// Close stop the ui and restore the terminal
+func (t *TUI) Close() {
+	close(t.done)
+	fmt.Print(ansiMainScreen)
+	t.term.Restore()
+}
+
+// readKeys read the keys pressed
+func (t *TUI) readKeys() {
+	r := bufio.NewReader(os.Stdin)
+	for {
+		k, e := r.ReadByte()
+		if e != nil {
+			return
+		}
+		select {
+		case t.keys <- k:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// draw render the screen
+func (t *TUI) draw(now time.Time) {
+	width, height := t.term.Size()
+	s := t.h.Snapshot()
+
+	var requests int64
+	for _, m := range s.metrics {
+		requests += m.request
+	}
+	if d := now.Sub(t.last).Seconds(); d >= TUIRefresh.Seconds()/2 {
+		t.qps = float64(requests-t.requests) / d
+		t.requests, t.last = requests, now
+	}
+
+	var lines []string
+	lines = append(lines, ansiReverse+fmt.Sprintf("hamburg - %s - %s - up %v    q:quit  sort t:total c:count a:avg p:p99 m:max e:errors",
+		s.protocol, now.Format("2006-01-02 15:04:05"), now.Sub(t.start).Truncate(time.Second))+ansiReset)
+
+	errate := 0.0
+	if s.hist.Count > 0 {
+		errate = float64(s.errors) / float64(s.hist.Count) * 100
+	}
+	lines = append(lines, fmt.Sprintf("QPS: %.1f  Requests: %d  Responses: %d  Slow: %d  Errors: %d (%.2f%%)",
+		t.qps, requests, s.hist.Count, s.slow, s.errors, errate))
+	rtt := "-"
+	if s.rtts > 0 {
+		rtt = fmt.Sprintf("%v", s.rtt/time.Duration(s.rtts))
+	}
+	lines = append(lines, fmt.Sprintf("Latency: avg %v  p50 %v  p90 %v  p99 %v  p999 %v  max %v  rtt %s",
+		s.hist.Mean(), s.hist.Quantile(0.5), s.hist.Quantile(0.9), s.hist.Quantile(0.99), s.hist.Quantile(0.999), s.hist.Max, rtt))
+	lines = append(lines, "")
+
+	// Split the rest rows among the commands, clients and recent slow requests
+	rest := height - len(lines) - 6
+	if rest < 3 {
+		rest = 3
+	}
+	ncmd, ncli := rest*2/5, rest/4
+	nslow := rest - ncmd - ncli
+
+	lines = append(lines, ansiBold+fmt.Sprintf("Slowest commands (sort by %s)", TUISorts[t.sort])+ansiReset)
+	lines = append(lines, ansiReverse+fmt.Sprintf("%-24s %-16s %10s %8s %12s %10s %10s %10s",
+		"SERVER", "COMMAND", "COUNT", "ERRORS", "TOTAL", "AVG", "P99", "MAX")+ansiReset)
+	for _, m := range t.commands(s, ncmd) {
+		lines = append(lines, fmt.Sprintf("%-24s %-16s %10d %8d %12v %10v %10v %10v",
+			m.server, m.command, m.count, m.errors, m.cost.Truncate(time.Microsecond),
+			m.hist.Mean(), m.hist.Quantile(0.99), m.hist.Max))
+	}
+
+	lines = append(lines, ansiBold+"Busiest clients"+ansiReset)
+	lines = append(lines, ansiReverse+fmt.Sprintf("%-40s %10s %10s %8s %8s %10s",
+		"CLIENT", "REQUESTS", "RESPONSES", "SLOW", "ERRORS", "AVG")+ansiReset)
+	for _, c := range t.clients(s, ncli) {
+		avg := time.Duration(0)
+		if c.count > 0 {
+			avg = c.cost / time.Duration(c.count)
+		}
+		lines = append(lines, fmt.Sprintf("%-40s %10d %10d %8d %8d %10v", c.ip, c.request, c.count, c.slow, c.errors, avg))
+	}
+
+	lines = append(lines, ansiBold+"Recent slow requests"+ansiReset)
+	events := t.h.output.Recent()
+	if len(events) > nslow {
+		events = events[:nslow]
+	}
+	for _, e := range events {
+		lines = append(lines, fmt.Sprintf("%s | %s -> %s | %v | %s",
+			e.Time.Format("15:04:05"), e.Client, e.Server, e.cost, e.Request))
+	}
+
+	var b strings.Builder
+	b.WriteString(ansiHome)
+	for i, line := range lines {
+		if i >= height {
+			break
+		}
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(clip(line, width))
+		b.WriteString(ansiClearLine)
+	}
+	b.WriteString(ansiClearDown)
+	fmt.Print(b.String())
+}
+
+// commands the top n commands in the sort order
+func (t *TUI) commands(s *State, n int) []*Metric {
+	var metrics []*Metric
+	for _, m := range s.metrics {
+		if m.count > 0 {
+			metrics = append(metrics, m)
+		}
+	}
+
+	key := func(m *Metric) float64 {
+		switch t.sort {
+		case 'c':
+			return float64(m.count)
+		case 'a':
+			return float64(m.hist.Mean())
+		case 'p':
+			return float64(m.hist.Quantile(0.99))
+		case 'm':
+			return float64(m.hist.Max)
+		case 'e':
+			return float64(m.errors)
+		}
+		return float64(m.cost)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return key(metrics[i]) > key(metrics[j])
+	})
+	if len(metrics) > n {
+		metrics = metrics[:n]
+	}
+
+	return metrics
+}
+
+// clients the top n clients with the most requests
+func (t *TUI) clients(s *State, n int) []*Client {
+	var clients []*Client
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].request > clients[j].request
+	})
+	if len(clients) > n {
+		clients = clients[:n]
+	}
+
+	return clients
+}
+
+// clip cut the line to the width of screen, the escape sequences are not counted
+func clip(line string, width int) string {
+	var b strings.Builder
+	n, esc := 0, false
+	for _, c := range line {
+		switch {
+		case esc:
+			esc = c < '@' || c > '~' || c == '['
+		case c == '\x1b':
+			esc = true
+		case n >= width:
+			continue
+		default:
+			n++
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
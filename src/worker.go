@@ -0,0 +1,253 @@
+package src
+
+import (
+	"fmt"
+	"sync"
+
+	p "github.com/bugwz/hamburg/parser"
+	"github.com/google/gopacket"
+)
+
+// WorkerQueueSize packets buffered for each worker
+const WorkerQueueSize = 4096
+
+// Worker decode and match the packets of one shard of flows
+type Worker struct {
+	Parser    *Parser
+	Assembler *Assembler
+	RTT       *RTT
+	Keeper    *Keeper
+	Tracker   *Tracker
+	State     *State
+	sniffer   *Sniffer
+	output    *Output
+	protocol  string
+	packets   chan gopacket.Packet // Packets dispatched to this worker
+	hooks     *Hooks               // Callbacks of the packets and matched requests
+	comments  []string             // Annotations of the packet being processed
+	slows     []*p.Packet          // Slow requests whose replies are completed by the packet
+	matched   bool                 // Whether the packet completes any reply
+}
+
+// NewWorker new worker
+func NewWorker(c *Conf, sniffer *Sniffer, output *Output, hooks *Hooks) (*Worker, error) {
+	parser, e := NewParser(c)
+	if e != nil {
+		return nil, e
+	}
+
+	state, e := NewState(c)
+	if e != nil {
+		return nil, e
+	}
+
+	return &Worker{
+		Parser:    parser,
+		Assembler: NewAssembler(),
+		RTT:       NewRTT(),
+		Keeper:    sniffer.NewKeeper(),
+		Tracker:   NewTracker(),
+		State:     state,
+		sniffer:   sniffer,
+		output:    output,
+		protocol:  c.Protocol,
+		packets:   make(chan gopacket.Packet, WorkerQueueSize),
+		hooks:     hooks,
+	}, nil
+}
+
+// Run process the dispatched packets until the queue is closed
+func (w *Worker) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer w.Parser.CloseScript()
+	for pkt := range w.packets {
+		w.ParsePackets(&pkt)
+	}
+}
+
+// ParsePackets parser packets
+func (w *Worker) ParsePackets(gop *gopacket.Packet) {
+	// 1) Parsing layers of packets
+	pkt := w.Parser.UnpackLayers(gop)
+
+	// 2) Determine the direction of the data
+	w.SetDirection(pkt)
+	defer w.Release(pkt)
+	defer w.SavePacket(gop, pkt)
+
+	// 3) Update process status
+	w.State.IncrReqRsp(pkt.Request)
+	if w.hooks.Packet != nil {
+		w.hooks.Packet(pkt)
+	}
+
+	// 4) Try run custom script
+	e := w.Parser.RunScript(pkt)
+	if e == nil {
+		return
+	}
+	if e != ErrNoScript {
+		w.output.WriteError(e)
+	}
+
+	// 5) Reassemble tcp segments into complete messages
+	w.RTT.Observe(pkt)
+	msgs, lost := w.Assembler.Reassemble(pkt, w.Parser.Splitter())
+	if lost {
+		// The replies of the outstanding requests can not be matched any more
+		w.Parser.Reset(pkt)
+		w.State.DropRequests(p.ConnID(pkt))
+	}
+
+	// 6) Processing request and reply packet pairs
+	if pkt.Payload == "" {
+		reqid := fmt.Sprintf("%s -> %s", pkt.SrcID, pkt.DstID)
+		rspid := fmt.Sprintf("%s -> %s", pkt.DstID, pkt.SrcID)
+		if pkt.Request && pkt.Flag&SYN != 0 {
+			w.State.DropRequests(reqid)
+		}
+		if !pkt.Request && (pkt.Flag&RST != 0 || pkt.Flag&FIN != 0) {
+			w.State.DropRequests(rspid)
+		}
+	}
+
+	for _, msg := range msgs {
+		// The connection is known from the direction of the packet, the parser may
+		// relabel the message such as the cancellation of a request by client
+		id := p.ConnID(msg)
+
+		// Run the preset parsing script
+		w.Parser.Run(msg)
+		if msg.Ignore {
+			continue
+		}
+		for _, v := range msg.Implied {
+			w.MatchPackets(id, v)
+		}
+		w.MatchPackets(id, msg)
+	}
+}
+
+// Release release the state kept for the connections closed by both sides, reset
+// or idle, which is done after the packet is saved
+func (w *Worker) Release(pkt *p.Packet) {
+	for _, c := range w.Tracker.Observe(pkt) {
+		v := c.Packet()
+		w.Parser.Close(v)
+		w.RTT.Close(v)
+		w.Assembler.Close(c.client, c.server)
+		w.State.DropRequests(p.ConnID(v))
+		if w.Keeper != nil {
+			w.Keeper.Close(p.ConnID(v))
+		}
+	}
+}
+
+// MatchPackets match the reply with the outstanding request of the connection id
+func (w *Worker) MatchPackets(id string, pkt *p.Packet) {
+	if pkt.Request {
+		w.State.Route(pkt)
+		w.State.IncrCommand(pkt)
+		w.State.PushRequest(id, pkt)
+		w.comments = append(w.comments, fmt.Sprintf("hamburg: request %s", annotate(pkt)))
+		return
+	}
+
+	ret := w.State.PopRequest(id, pkt)
+	if ret == nil {
+		return
+	}
+
+	td := pkt.Timestap.Sub(ret.Timestap)
+	process, rtt, ok := w.RTT.Split(id, td)
+	w.State.AddDuration(ret, pkt, td)
+	w.State.AddNetwork(process, rtt, ok)
+	if w.hooks.match != nil {
+		w.hooks.match()
+	}
+
+	slow := w.State.FitSlow(td)
+	w.matched = true
+	w.comments = append(w.comments, fmt.Sprintf("hamburg: reply of %s in %v", annotate(ret), td))
+	if slow {
+		w.slows = append(w.slows, ret)
+		w.comments[len(w.comments)-1] += fmt.Sprintf(", slow (threshold %v)", w.State.slowline)
+	}
+	if !slow && w.hooks.Transaction == nil {
+		return
+	}
+	e := NewEvent(w.protocol, ret, pkt, process, rtt)
+	if w.hooks.Transaction != nil {
+		w.hooks.Transaction(e)
+	}
+	if slow {
+		w.output.Write(e)
+		if w.hooks.Slow != nil {
+			w.hooks.Slow(e)
+		}
+	}
+}
+
+// SavePacket save the processed packet with its annotations, and the kept packets
+// of the slow requests completed by it
+func (w *Worker) SavePacket(gop *gopacket.Packet, pkt *p.Packet) {
+	ci, data := (*gop).Metadata().CaptureInfo, (*gop).Data()
+	comments, slows, matched := w.comments, w.slows, w.matched
+	w.comments, w.slows, w.matched = nil, w.slows[:0], false
+
+	if w.Keeper == nil {
+		if e := w.sniffer.SavePacket(ci, data, comments); e != nil {
+			w.output.WriteError(e)
+		}
+		if len(slows) > 0 {
+			if e := w.sniffer.DumpRing(); e != nil {
+				w.output.WriteError(e)
+			}
+		}
+		return
+	}
+
+	id := p.ConnID(pkt)
+	w.Keeper.Add(id, ci, data, comments)
+	for _, req := range slows {
+		w.Keeper.Save(id, req)
+	}
+	if matched {
+		oldest, pending := w.State.Oldest(id)
+		w.Keeper.Trim(id, oldest, pending)
+	}
+}
+
+// SetDirection set request direction
+func (w *Worker) SetDirection(v *p.Packet) {
+	// Using IP to determine the request direction of packets
+	if w.sniffer.localip[v.SrcIP] != "" {
+		v.Request = false
+	}
+	if w.sniffer.localip[v.DstIP] != "" {
+		v.Request = true
+	}
+
+	// Using Port to determine the request direction of packets
+	if v.SrcPort != "" && v.DstPort != "" {
+		for _, port := range w.sniffer.ports {
+			if v.SrcPort == port {
+				v.Request = false
+				break
+			}
+			if v.DstPort == port {
+				v.Request = true
+				break
+			}
+		}
+		return
+	}
+
+	// Use recorded historical packets to determine direction
+	if v.SrcIP != "" && v.DstIP != "" {
+		reqid := fmt.Sprintf("%s -> %s", v.DstID, v.SrcID)
+		if _, exits := w.State.dict.Get(reqid); exits {
+			v.Request = false
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"runtime"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Link types beyond the ones decoded by gopacket, whose layers.LinkType is only 8 bits
+const (
+	LinkTypeRaw       = 101
+	LinkTypeIPv4      = 228
+	LinkTypeIPv6      = 229
+	LinkTypeLinuxSLL2 = 276
+)
+
+// LayerTypeLinuxSLL2 layer type of the linux cooked capture v2
+var LayerTypeLinuxSLL2 = gopacket.RegisterLayerType(1276, gopacket.LayerTypeMetadata{
+	Name:    "Linux SLL2",
+	Decoder: gopacket.DecodeFunc(decodeLinuxSLL2),
+})
+
+// LinuxSLL2 header of the linux cooked capture v2, which is used when capturing on "any"
+type LinuxSLL2 struct {
+	layers.BaseLayer
+	EthernetType   layers.EthernetType
+	InterfaceIndex uint32
+	AddrType       uint16
+	PacketType     layers.LinuxSLLPacketType
+	AddrLen        uint8
+	Addr           net.HardwareAddr
+}
+
+// LayerType layer type
+func (sll *LinuxSLL2) LayerType() gopacket.LayerType { return LayerTypeLinuxSLL2 }
+
+// CanDecode layer class decoded
+func (sll *LinuxSLL2) CanDecode() gopacket.LayerClass { return LayerTypeLinuxSLL2 }
+
+// LinkFlow flow of the link layer, only the sender address is known
+func (sll *LinuxSLL2) LinkFlow() gopacket.Flow {
+	return gopacket.NewFlow(layers.EndpointMAC, sll.Addr, nil)
+}
+
+// NextLayerType layer type of the payload
+func (sll *LinuxSLL2) NextLayerType() gopacket.LayerType {
+	return sll.EthernetType.LayerType()
+}
+
+// DecodeFromBytes decode the 20 bytes header
+func (sll *LinuxSLL2) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 20 {
+		return errors.New("Linux SLL2 packet too small")
+	}
+	sll.EthernetType = layers.EthernetType(binary.BigEndian.Uint16(data[0:2]))
+	sll.InterfaceIndex = binary.BigEndian.Uint32(data[4:8])
+	sll.AddrType = binary.BigEndian.Uint16(data[8:10])
+	sll.PacketType = layers.LinuxSLLPacketType(data[10])
+	sll.AddrLen = data[11]
+	n := int(sll.AddrLen)
+	if n > 8 {
+		n = 8
+	}
+	sll.Addr = net.HardwareAddr(data[12 : 12+n])
+	sll.BaseLayer = layers.BaseLayer{Contents: data[:20], Payload: data[20:]}
+
+	return nil
+}
+
+// decodeLinuxSLL2 decode the linux cooked capture v2 and its payload
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	sll := &LinuxSLL2{}
+	if e := sll.DecodeFromBytes(data, p); e != nil {
+		return e
+	}
+	p.AddLayer(sll)
+	p.SetLinkLayer(sll)
+
+	return p.NextDecoder(sll.EthernetType)
+}
+
+// GetLinkType get the link type of the packet source, which is truncated into
+// 8 bits by pcap.Handle.LinkType, and normalize the platform dependent values
+func GetLinkType(h *pcap.Handle) int {
+	lt := int(h.LinkType())
+	if dls, e := h.ListDataLinks(); e == nil {
+		for _, dl := range dls {
+			if v := pcap.DatalinkNameToVal(dl.Name); v > 0xff && v&0xff == lt {
+				lt = v
+				break
+			}
+		}
+	}
+
+	// The raw ip is 12 or 14 in pcap_datalink except OpenBSD whose 12 is loop
+	switch {
+	case lt == 12 && runtime.GOOS == "openbsd":
+		return int(layers.LinkTypeLoop)
+	case lt == 12 || lt == 14:
+		return LinkTypeRaw
+	}
+
+	return lt
+}
+
+// LinkDecoder decoder of the packets with the link type
+func LinkDecoder(lt int) gopacket.Decoder {
+	switch lt {
+	case LinkTypeIPv4:
+		return layers.LayerTypeIPv4
+	case LinkTypeIPv6:
+		return layers.LayerTypeIPv6
+	case LinkTypeLinuxSLL2:
+		return LayerTypeLinuxSLL2
+	}
+
+	return layers.LinkType(lt)
+}
@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"encoding/binary"
+	"io"
+	"runtime"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Formats of the capture file
+const (
+	PcapFormat   = "pcap"
+	PcapngFormat = "pcapng"
+)
+
+// Block types and option codes of pcapng
+const (
+	ngSectionHeader       = 0x0A0D0D0A
+	ngInterface           = 0x00000001
+	ngEnhancedPacket      = 0x00000006
+	ngByteOrderMagic      = 0x1A2B3C4D
+	ngOptEnd              = 0
+	ngOptComment          = 1
+	ngOptSHBOS            = 3
+	ngOptSHBUserAppl      = 4
+	ngOptIfName           = 2
+	ngOptIfTsresol        = 9
+	ngOptIfFilter         = 11
+	ngOptIfOS             = 12
+	ngTimestampNanos      = 9
+	ngMaxOptionLen        = 0xFFFF
+	pcapMagicMicroseconds = 0xA1B2C3D4
+	pcapFileHeaderLen     = 24
+	pcapRecordLen         = 16
+)
+
+// PacketSource capture source described in the file header
+type PacketSource struct {
+	Name     string // Network interface or offline pcap file
+	Filter   string // Bpf filter of the capture
+	LinkType int    // Link type of the packets
+	SnapLen  int    // Snapshot length
+}
+
+// packetEncoder encode the file header and packets of a capture file
+type packetEncoder interface {
+	// WriteHeader write the file header and return its size
+	WriteHeader(src PacketSource) (int64, error)
+	// WritePacket write the packet with comments and return its size
+	WritePacket(ci gopacket.CaptureInfo, data []byte, comments []string) (int64, error)
+}
+
+// newPacketEncoder new encoder of the format
+func newPacketEncoder(format string, w io.Writer) packetEncoder {
+	if format == PcapngFormat {
+		return &pcapngEncoder{w: w}
+	}
+
+	return &pcapEncoder{o: w, w: pcapgo.NewWriter(w)}
+}
+
+// pcapEncoder encoder of the classic pcap format, which can not carry comments
+type pcapEncoder struct {
+	o io.Writer
+	w *pcapgo.Writer
+}
+
+// WriteHeader write the pcap file header, which is written here instead of
+// pcapgo.Writer for the link types beyond 8 bits
+func (w *pcapEncoder) WriteHeader(src PacketSource) (int64, error) {
+	b := make([]byte, pcapFileHeaderLen)
+	binary.LittleEndian.PutUint32(b[0:4], pcapMagicMicroseconds)
+	binary.LittleEndian.PutUint16(b[4:6], 2)
+	binary.LittleEndian.PutUint16(b[6:8], 4)
+	binary.LittleEndian.PutUint32(b[16:20], uint32(src.SnapLen))
+	binary.LittleEndian.PutUint32(b[20:24], uint32(src.LinkType))
+	_, e := w.o.Write(b)
+
+	return pcapFileHeaderLen, e
+}
+
+// WritePacket write the packet record, the comments are dropped
+func (w *pcapEncoder) WritePacket(ci gopacket.CaptureInfo, data []byte, comments []string) (int64, error) {
+	return int64(pcapRecordLen + len(data)), w.w.WritePacket(ci, data)
+}
+
+// pcapngEncoder encoder of the pcapng format with a single section and interface,
+// the packets are written as enhanced packet blocks with comment options
+type pcapngEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+// ngOption option of pcapng block
+type ngOption struct {
+	code  uint16
+	value []byte
+}
+
+// ngPadding padding bytes aligning n to 32 bits
+func ngPadding(n int) int {
+	return (4 - n&3) & 3
+}
+
+// WriteHeader write the section header block and interface description block
+func (w *pcapngEncoder) WriteHeader(src PacketSource) (int64, error) {
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], ngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:6], 1)
+	binary.LittleEndian.PutUint16(shb[6:8], 0)
+	binary.LittleEndian.PutUint64(shb[8:16], 0xFFFFFFFFFFFFFFFF)
+	n, e := w.block(ngSectionHeader, shb, []ngOption{
+		{ngOptSHBUserAppl, []byte("hamburg")},
+		{ngOptSHBOS, []byte(runtime.GOOS)},
+	})
+	if e != nil {
+		return n, e
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], uint16(src.LinkType))
+	binary.LittleEndian.PutUint32(idb[4:8], uint32(src.SnapLen))
+	var options []ngOption
+	if src.Name != "" {
+		options = append(options, ngOption{ngOptIfName, []byte(src.Name)})
+	}
+	if src.Filter != "" {
+		options = append(options, ngOption{ngOptIfFilter, append([]byte{0}, src.Filter...)})
+	}
+	options = append(options,
+		ngOption{ngOptIfOS, []byte(runtime.GOOS)},
+		ngOption{ngOptIfTsresol, []byte{ngTimestampNanos}},
+	)
+	m, e := w.block(ngInterface, idb, options)
+
+	return n + m, e
+}
+
+// WritePacket write the enhanced packet block with a comment option for each comment
+func (w *pcapngEncoder) WritePacket(ci gopacket.CaptureInfo, data []byte, comments []string) (int64, error) {
+	ts := uint64(ci.Timestamp.UnixNano())
+	body := make([]byte, 20, 20+len(data)+3)
+	binary.LittleEndian.PutUint32(body[0:4], uint32(ci.InterfaceIndex))
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(ci.Length))
+	body = append(body, data...)
+	body = append(body, make([]byte, ngPadding(len(data)))...)
+
+	var options []ngOption
+	for _, c := range comments {
+		if len(c) > ngMaxOptionLen {
+			c = c[:ngMaxOptionLen]
+		}
+		options = append(options, ngOption{ngOptComment, []byte(c)})
+	}
+
+	return w.block(ngEnhancedPacket, body, options)
+}
+
+// block write the block of type with the body and options, return its size
+func (w *pcapngEncoder) block(typ uint32, body []byte, options []ngOption) (int64, error) {
+	size := 12 + len(body)
+	for _, o := range options {
+		size += 4 + len(o.value) + ngPadding(len(o.value))
+	}
+	if len(options) > 0 {
+		size += 4
+	}
+
+	if cap(w.buf) < size {
+		w.buf = make([]byte, size)
+	}
+	b := w.buf[:size]
+	for i := range b {
+		b[i] = 0
+	}
+	binary.LittleEndian.PutUint32(b[0:4], typ)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(size))
+	pos := 8 + copy(b[8:], body)
+	for _, o := range options {
+		binary.LittleEndian.PutUint16(b[pos:pos+2], o.code)
+		binary.LittleEndian.PutUint16(b[pos+2:pos+4], uint16(len(o.value)))
+		pos += 4 + copy(b[pos+4:], o.value) + ngPadding(len(o.value))
+	}
+	if len(options) > 0 {
+		pos += 4 // End of options
+	}
+	binary.LittleEndian.PutUint32(b[pos:pos+4], uint32(size))
+
+	_, e := w.w.Write(b)
+	return int64(size), e
+}
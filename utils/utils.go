@@ -8,9 +8,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/pcapgo"
 )
 
 // FileIsExist check file
@@ -34,6 +32,13 @@ func GetIPs(v string) ([]string, error) {
 	ips := strings.Split(v, ",")
 	for _, ip := range ips {
 		if len(ip) != 0 {
+			// Both IPv4/IPv6 hosts and prefixes are accepted
+			if strings.Contains(ip, "/") {
+				if _, _, err := net.ParseCIDR(ip); err != nil {
+					return nil, fmt.Errorf("IP prefix %s is illegal", ip)
+				}
+				continue
+			}
 			if net.ParseIP(ip) == nil {
 				return nil, fmt.Errorf("IP %s is illegal", ip)
 			}
@@ -110,6 +115,9 @@ func GetLocalIPs(v string) (map[string]string, error) {
 	for _, d := range ds {
 		if d.Name == v {
 			for _, item := range d.Addresses {
+				if item.IP == nil {
+					continue
+				}
 				ips[item.IP.String()] = item.Netmask.String()
 			}
 			return ips, nil
@@ -119,23 +127,6 @@ func GetLocalIPs(v string) (map[string]string, error) {
 	return nil, nil
 }
 
-// GetPacketWriter get packet writer
-func GetPacketWriter(v string, snaplen int) (*pcapgo.Writer, error) {
-	if v == "" {
-		return nil, nil
-	}
-
-	fh, e := os.Create(v)
-	if e != nil {
-		return nil, e
-	}
-
-	fw := pcapgo.NewWriter(fh)
-	fw.WriteFileHeader(uint32(snaplen), layers.LinkTypeEthernet)
-
-	return fw, nil
-}
-
 // PacketFilter set packet filtering rules
 func PacketFilter(custom, ports, ips string) (string, error) {
 	var fts, pfs, sfs []string
@@ -151,7 +142,11 @@ func PacketFilter(custom, ports, ips string) (string, error) {
 	// IP filter
 	for _, ip := range strings.Split(ips, ",") {
 		if len(ip) != 0 {
-			sfs = append(sfs, fmt.Sprintf("(host %s)", ip))
+			if strings.Contains(ip, "/") {
+				sfs = append(sfs, fmt.Sprintf("(net %s)", ip))
+			} else {
+				sfs = append(sfs, fmt.Sprintf("(host %s)", ip))
+			}
 		}
 	}
 	fts = AddFilters(fts, sfs)
@@ -0,0 +1,262 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// PacketWriter buffered writer of the pcap files, the files are rotated by size or time
+// and named as "name-N.ext" when rotation or ring buffer is enabled, the files named
+// as "*.pcapng" are written in pcapng format with the comments of packets
+type PacketWriter struct {
+	mu       sync.Mutex
+	path     string        // Path of the output file
+	format   string        // Format of the files, pcap or pcapng
+	src      PacketSource  // Capture source in file header
+	indexed  bool          // Whether the files are named with index
+	maxsize  int64         // Rotate the file when its size exceeds
+	maxage   time.Duration // Rotate the file when the packets in it span longer than
+	maxfiles int           // Remove the oldest files beyond the count
+	index    int           // Index of the current file
+	size     int64         // Size of the current file
+	first    time.Time     // Capture time of the first packet in current file
+	w        packetEncoder
+	buf      *bufio.Writer
+	file     *os.File
+}
+
+// GetPacketWriter get packet writer, the file is rotated when it is larger than size bytes
+// or its packets span longer than age, and only the latest files are kept if files is not 0
+func GetPacketWriter(v string, src PacketSource, size int64, age time.Duration, files int, ring bool) (*PacketWriter, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	format := PcapFormat
+	if strings.EqualFold(filepath.Ext(v), "."+PcapngFormat) {
+		format = PcapngFormat
+	}
+	w := &PacketWriter{
+		path:     v,
+		format:   format,
+		src:      src,
+		indexed:  size > 0 || age > 0 || ring,
+		maxsize:  size,
+		maxage:   age,
+		maxfiles: files,
+	}
+
+	// The files of ring buffer are created when it is dumped
+	if !ring {
+		if e := w.open(); e != nil {
+			return nil, e
+		}
+	}
+
+	return w, nil
+}
+
+// name path of the file with index
+func (w *PacketWriter) name(index int) string {
+	if !w.indexed {
+		return w.path
+	}
+
+	ext := filepath.Ext(w.path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(w.path, ext), index, ext)
+}
+
+// open create the next file and remove the oldest one beyond the count
+func (w *PacketWriter) open() error {
+	w.index++
+	fh, e := os.Create(w.name(w.index))
+	if e != nil {
+		return e
+	}
+
+	w.file = fh
+	w.buf = bufio.NewWriter(fh)
+	w.w = newPacketEncoder(w.format, w.buf)
+	w.first = time.Time{}
+	if w.size, e = w.w.WriteHeader(w.src); e != nil {
+		return e
+	}
+
+	if w.indexed && w.maxfiles > 0 && w.index > w.maxfiles {
+		os.Remove(w.name(w.index - w.maxfiles))
+	}
+
+	return nil
+}
+
+// close flush and close the current file
+func (w *PacketWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+
+	fh := w.file
+	w.file = nil
+	if e := w.buf.Flush(); e != nil {
+		fh.Close()
+		return fmt.Errorf("Flush packets into %s failed: %v", fh.Name(), e)
+	}
+
+	return fh.Close()
+}
+
+// WritePacket write the packet with comments and rotate the file when necessary,
+// the comments are only kept in pcapng format
+func (w *PacketWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, comments []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.write(ci, data, comments)
+}
+
+// write write the packet without lock
+func (w *PacketWriter) write(ci gopacket.CaptureInfo, data []byte, comments []string) error {
+	rotate := w.file == nil
+	if w.maxsize > 0 && w.size+int64(pcapRecordLen+len(data)) > w.maxsize && !w.first.IsZero() {
+		rotate = true
+	}
+	if w.maxage > 0 && !w.first.IsZero() && ci.Timestamp.Sub(w.first) >= w.maxage {
+		rotate = true
+	}
+	if rotate {
+		if e := w.rotate(); e != nil {
+			return e
+		}
+	}
+
+	if w.first.IsZero() {
+		w.first = ci.Timestamp
+	}
+	n, e := w.w.WritePacket(ci, data, comments)
+	w.size += n
+
+	return e
+}
+
+// rotate close the current file and create the next one
+func (w *PacketWriter) rotate() error {
+	if e := w.close(); e != nil {
+		return e
+	}
+
+	return w.open()
+}
+
+// Close flush the buffered packets and close the file
+func (w *PacketWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.close()
+}
+
+// RingPacket packet kept in ring buffer
+type RingPacket struct {
+	ci       gopacket.CaptureInfo
+	data     []byte
+	comments []string
+}
+
+// PacketRing keep the latest packets in memory, and dump them into a new file on demand
+type PacketRing struct {
+	mu      sync.Mutex
+	max     int64         // Maximum bytes of the packets kept
+	size    int64         // Bytes of the packets kept
+	packets []*RingPacket // Packets from the oldest to the latest
+	gap     time.Duration // Minimum interval of capture time between two dumps
+	now     time.Time     // Capture time of the latest packet kept
+	last    time.Time     // Capture time of the last dump, so that offline files are dumped alike
+	pending bool          // Whether a dump was skipped for the interval
+}
+
+// NewPacketRing new packet ring keeping size bytes of packets, the dumps are
+// at least gap apart so that a burst of incidents does not produce tiny files
+func NewPacketRing(size int64, gap time.Duration) *PacketRing {
+	return &PacketRing{max: size, gap: gap}
+}
+
+// Add keep a copy of the packet with comments and drop the oldest ones beyond the size,
+// return whether the postponed dump is due and should be flushed
+func (r *PacketRing) Add(ci gopacket.CaptureInfo, data []byte, comments []string) bool {
+	pkt := &RingPacket{ci: ci, data: append([]byte(nil), data...), comments: comments}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.packets = append(r.packets, pkt)
+	r.size += int64(len(data))
+	if ci.Timestamp.After(r.now) {
+		r.now = ci.Timestamp
+	}
+	drop := 0
+	for r.size > r.max && drop < len(r.packets)-1 {
+		r.size -= int64(len(r.packets[drop].data))
+		r.packets[drop] = nil
+		drop++
+	}
+	r.packets = r.packets[drop:]
+
+	return r.pending && r.now.Sub(r.last) >= r.gap
+}
+
+// Dump write the packets kept into a new file of writer and clear the ring,
+// the dump is postponed if the last one is too recent
+func (r *PacketRing) Dump(w *PacketWriter) error {
+	r.mu.Lock()
+	if r.now.Sub(r.last) < r.gap {
+		r.pending = true
+		r.mu.Unlock()
+		return nil
+	}
+
+	return r.dump(w)
+}
+
+// Flush write the packets of the postponed dump, which is done once its gap expires
+// or the capture is closed
+func (r *PacketRing) Flush(w *PacketWriter) error {
+	r.mu.Lock()
+	if !r.pending {
+		r.mu.Unlock()
+		return nil
+	}
+
+	return r.dump(w)
+}
+
+// dump take the packets kept and write them, the lock of ring held by caller is released
+func (r *PacketRing) dump(w *PacketWriter) error {
+	packets := r.packets
+	r.packets, r.size = nil, 0
+	r.last, r.pending = r.now, false
+	r.mu.Unlock()
+
+	if len(packets) == 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e := w.rotate(); e != nil {
+		return e
+	}
+	for _, pkt := range packets {
+		if _, e := w.w.WritePacket(pkt.ci, pkt.data, pkt.comments); e != nil {
+			return e
+		}
+	}
+
+	return w.close()
+}